@@ -0,0 +1,66 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PendingClaimsAnnotation is the annotation of pool holding the containers
+// waiting for the pool to grow, as a json object of container id to the time
+// they give up waiting
+const PendingClaimsAnnotation = "ipam.k8s.cc.cs.nctu.edu.tw/pending-claims"
+
+// PendingClaims return the claims of pool still waiting at now
+func (pool *IPPool) PendingClaims(now time.Time) map[string]time.Time {
+	claims := map[string]time.Time{}
+	raw, ok := pool.Annotations[PendingClaimsAnnotation]
+	if !ok {
+		return claims
+	}
+	if err := json.Unmarshal([]byte(raw), &claims); err != nil {
+		return map[string]time.Time{}
+	}
+	for id, until := range claims {
+		if !until.After(now) {
+			delete(claims, id)
+		}
+	}
+	return claims
+}
+
+// SetPendingClaim add the claim of container id waiting until, or remove it if
+// until is zero. The claims expired at now are dropped on the way.
+func (pool *IPPool) SetPendingClaim(id string, until, now time.Time) {
+	claims := pool.PendingClaims(now)
+	if until.IsZero() {
+		delete(claims, id)
+	} else {
+		claims[id] = until
+	}
+
+	if len(claims) == 0 {
+		delete(pool.Annotations, PendingClaimsAnnotation)
+		return
+	}
+	raw, _ := json.Marshal(claims)
+	if pool.Annotations == nil {
+		pool.Annotations = map[string]string{}
+	}
+	pool.Annotations[PendingClaimsAnnotation] = string(raw)
+}
@@ -0,0 +1,49 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GetCondition return the condition with condType, or nil if not present
+func (s *IPPoolStatus) GetCondition(condType IPPoolConditionType) *IPPoolCondition {
+	for idx := range s.Conditions {
+		if s.Conditions[idx].Type == condType {
+			return &s.Conditions[idx]
+		}
+	}
+	return nil
+}
+
+// SetCondition add or update the condition with condType. The transition
+// time is only changed when the status changes.
+func (s *IPPoolStatus) SetCondition(condType IPPoolConditionType,
+	status corev1.ConditionStatus, reason, message string) {
+	cond := s.GetCondition(condType)
+	if cond == nil {
+		s.Conditions = append(s.Conditions, IPPoolCondition{Type: condType})
+		cond = &s.Conditions[len(s.Conditions)-1]
+	}
+	if cond.Status != status {
+		cond.Status = status
+		cond.LastTransitionTime = metav1.Now()
+	}
+	cond.Reason = reason
+	cond.Message = message
+}
@@ -0,0 +1,73 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IsCooling report whether address is still in cooldown at now
+func (s *IPPoolSpec) IsCooling(address string, now time.Time) bool {
+	until, ok := s.Cooling[address]
+	return ok && until.Time.After(now)
+}
+
+// StartCooling put address in cooldown from now for ReleaseCooldown, if set
+func (s *IPPoolSpec) StartCooling(address string, now time.Time) {
+	if s.ReleaseCooldown == nil || s.ReleaseCooldown.Duration <= 0 {
+		return
+	}
+	if s.Cooling == nil {
+		s.Cooling = map[string]metav1.Time{}
+	}
+	s.Cooling[address] = metav1.NewTime(now.Add(s.ReleaseCooldown.Duration))
+}
+
+// RecordRelease set the release time of address to now and put it in
+// cooldown, and forget the release times of addresses no longer in pool
+func (s *IPPoolSpec) RecordRelease(address string, now time.Time) {
+	releases := map[string]metav1.Time{}
+	for _, addr := range s.Addresses {
+		if at, ok := s.Releases[addr]; ok {
+			releases[addr] = at
+		}
+	}
+	releases[address] = metav1.NewTime(now)
+	s.Releases = releases
+	s.StartCooling(address, now)
+}
+
+// SweepCooling drop the addresses whose cooldown expired at now, or which are
+// no longer in the pool. It report whether any is dropped.
+func (s *IPPoolSpec) SweepCooling(now time.Time) (swept bool) {
+	inPool := map[string]bool{}
+	for _, addr := range s.Addresses {
+		inPool[addr] = true
+	}
+	for addr := range s.Cooling {
+		if !inPool[addr] || !s.IsCooling(addr, now) {
+			delete(s.Cooling, addr)
+			swept = true
+		}
+	}
+	if len(s.Cooling) == 0 {
+		s.Cooling = nil
+	}
+	return
+}
@@ -0,0 +1,58 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// ReservationOf return the reservation of the pod, or nil if none
+func (s *IPPoolSpec) ReservationOf(namespace, name string) *IPReservation {
+	for idx := range s.Reservations {
+		rsv := &s.Reservations[idx]
+		if rsv.PodNamespace == namespace && rsv.PodName == name {
+			return rsv
+		}
+	}
+	return nil
+}
+
+// IsReserved report whether address is reserved for a pod
+func (s *IPPoolSpec) IsReserved(address string) bool {
+	for _, rsv := range s.Reservations {
+		if rsv.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Reserve keep address for the pod, replacing its former reservation
+func (s *IPPoolSpec) Reserve(address, namespace, name string) {
+	s.Unreserve(namespace, name)
+	s.Reservations = append(s.Reservations, IPReservation{
+		Address:      address,
+		PodName:      name,
+		PodNamespace: namespace,
+	})
+}
+
+// Unreserve drop the reservation of the pod, if any
+func (s *IPPoolSpec) Unreserve(namespace, name string) {
+	for idx, rsv := range s.Reservations {
+		if rsv.PodNamespace == namespace && rsv.PodName == name {
+			s.Reservations = append(s.Reservations[:idx], s.Reservations[idx+1:]...)
+			return
+		}
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -45,20 +46,253 @@ type IPPoolSpec struct {
 
 	// RawConfig is the driver specific configuration in raw json format
 	RawConfig string `json:"rawConfig"`
+
+	// MinFree is the count of free addresses below which the pool grows,
+	// default to 1. MaxFree is the count above which it shrinks, default to
+	// MinFree. Either way the pool is resized to halfway between them, so a
+	// gap between them keeps it from creating and deleting addresses back
+	// and forth.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	MinFree *int32 `json:"minFree,omitempty"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	MaxFree *int32 `json:"maxFree,omitempty"`
+
+	// MaxSize is the count of addresses the pool never grows beyond, 0 means
+	// no limit
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	MaxSize int32 `json:"maxSize,omitempty"`
+
+	// PredictWindow, if set, is the rolling window the allocation and
+	// release rate of pool is measured over. The addresses expected to be
+	// allocated before the next sync are created in advance, on top of
+	// MinFree and MaxFree.
+	// +kubebuilder:validation:Optional
+	PredictWindow *metav1.Duration `json:"predictWindow,omitempty"`
+
+	// AllocationStrategy is how the CNI choose among the free addresses,
+	// default to First
+	// +kubebuilder:validation:Optional
+	AllocationStrategy AllocationStrategy `json:"allocationStrategy,omitempty"`
+
+	// LastAllocated is the address allocated last, where the RoundRobin
+	// strategy goes on from
+	// +kubebuilder:validation:Optional
+	LastAllocated string `json:"lastAllocated,omitempty"`
+
+	// Releases is when each address was released last
+	// +kubebuilder:validation:Optional
+	Releases map[string]metav1.Time `json:"releases,omitempty"`
+
+	// ReleaseCooldown is how long a released address is kept from being
+	// allocated again, for the network devices to forget the old pod
+	// +kubebuilder:validation:Optional
+	ReleaseCooldown *metav1.Duration `json:"releaseCooldown,omitempty"`
+
+	// Cooling is the released addresses in cooldown, with the time they can
+	// be allocated again. The expired ones are swept by the controller.
+	// +kubebuilder:validation:Optional
+	Cooling map[string]metav1.Time `json:"cooling,omitempty"`
+
+	// Sticky keeps the address of a deleted pod reserved for it, so that the
+	// pod of the same namespace and name, e.g. of a StatefulSet, gets it
+	// back. The reservation is freed once the pod is gone for good.
+	// +kubebuilder:validation:Optional
+	Sticky bool `json:"sticky,omitempty"`
+
+	// Reservations is the addresses kept for pods in sticky mode
+	// +kubebuilder:validation:Optional
+	Reservations []IPReservation `json:"reservations,omitempty"`
+
+	// DriftPolicy is what sync does on drift between the pool and the
+	// external IPAM service, default to Warn
+	// +kubebuilder:validation:Optional
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+
+	// NodeSelector is the labels of the nodes whose pods may allocate from
+	// the pool, e.g. the rack of an L2 domain. Empty means every node.
+	// +kubebuilder:validation:Optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Network is the network parameters handed to pods with the addresses
+	// of pool. The CNI config may override each of them.
+	// +kubebuilder:validation:Optional
+	Network *IPPoolNetwork `json:"network,omitempty"`
 }
 
+// AllocationStrategy is a valid value for IPPoolSpec.AllocationStrategy
+// +kubebuilder:validation:Enum=First;Random;RoundRobin;LeastRecentlyReleased
+type AllocationStrategy string
+
+const (
+	// AllocationFirst choose the first free address in Addresses order
+	AllocationFirst AllocationStrategy = "First"
+	// AllocationRandom choose a free address at random
+	AllocationRandom AllocationStrategy = "Random"
+	// AllocationRoundRobin choose the next free address after the one
+	// allocated last
+	AllocationRoundRobin AllocationStrategy = "RoundRobin"
+	// AllocationLeastRecentlyReleased choose the free address released
+	// longest ago, never released ones first
+	AllocationLeastRecentlyReleased AllocationStrategy = "LeastRecentlyReleased"
+)
+
+// DriftPolicy is a valid value for IPPoolSpec.DriftPolicy
+// +kubebuilder:validation:Enum=Warn;Repair;Quarantine
+type DriftPolicy string
+
+const (
+	// DriftPolicyWarn only report the drift, the drifted addresses and
+	// allocations are left as they are
+	DriftPolicyWarn DriftPolicy = "Warn"
+	// DriftPolicyRepair make the external IPAM service agree with the pool,
+	// recreating missing addresses and taking back foreign held ones
+	DriftPolicyRepair DriftPolicy = "Repair"
+	// DriftPolicyQuarantine remove the drifted addresses from the allocable
+	// addresses of pool, and leave them untouched in the external service
+	DriftPolicyQuarantine DriftPolicy = "Quarantine"
+)
+
 // IPAllocation represents metadata about the pod/container owner of a specific IP
 type IPAllocation struct {
 	Address      string `json:"address"`
 	ContainerID  string `json:"id"`
 	PodName      string `json:"podName"`
 	PodNamespace string `json:"podNamespace"`
+
+	// AllocatedAt is when the address was allocated to the pod
+	// +kubebuilder:validation:Optional
+	AllocatedAt *metav1.Time `json:"allocatedAt,omitempty"`
+
+	// Requested tells the address was asked for by the pod, not chosen by
+	// the allocator
+	// +kubebuilder:validation:Optional
+	Requested bool `json:"requested,omitempty"`
+
+	// Pool is the pool allocated from, as namespace/name, when the CNI
+	// config lists several
+	// +kubebuilder:validation:Optional
+	Pool string `json:"pool,omitempty"`
+}
+
+// IPReservation represents an address kept for a pod which is not running
+type IPReservation struct {
+	Address      string `json:"address"`
+	PodName      string `json:"podName"`
+	PodNamespace string `json:"podNamespace"`
+}
+
+// IPPoolNetwork represents the network the addresses of a pool belong to
+type IPPoolNetwork struct {
+	// CIDR is the subnet of the addresses, e.g. 10.0.0.0/24, which gives
+	// their prefix length
+	// +kubebuilder:validation:Optional
+	CIDR string `json:"cidr,omitempty"`
+
+	// Gateway is the default gateway
+	// +kubebuilder:validation:Optional
+	Gateway string `json:"gateway,omitempty"`
+
+	// Routes is the routes of pods. The default route via Gateway is added
+	// unless one is given here, e.g. 0.0.0.0/0 with another gateway or metric.
+	// +kubebuilder:validation:Optional
+	Routes []IPRoute `json:"routes,omitempty"`
+
+	// DNS is the dns configuration of pods
+	// +kubebuilder:validation:Optional
+	DNS *IPDNS `json:"dns,omitempty"`
+}
+
+// IPRoute represents a route to a destination
+type IPRoute struct {
+	// Dst is the destination cidr
+	Dst string `json:"dst"`
+
+	// Gateway is the next hop, default to the gateway of network
+	// +kubebuilder:validation:Optional
+	Gateway string `json:"gateway,omitempty"`
+
+	// Metric is the priority of the route, lower is preferred
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	Metric int32 `json:"metric,omitempty"`
+}
+
+// IPDNS represents the dns configuration of pods
+type IPDNS struct {
+	// +kubebuilder:validation:Optional
+	Nameservers []string `json:"nameservers,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	Search []string `json:"search,omitempty"`
+
+	// Options is the resolver options, e.g. ndots:5
+	// +kubebuilder:validation:Optional
+	Options []string `json:"options,omitempty"`
+}
+
+// PrefixUsage represents the utilization of a prefix backing the pool
+type PrefixUsage struct {
+	// Prefix is the cidr of the prefix
+	Prefix string `json:"prefix"`
+
+	// Capacity is the count of usable addresses in the prefix
+	Capacity int64 `json:"capacity"`
+
+	// Used is the count of addresses existing in the prefix, of any owner
+	Used int64 `json:"used"`
+
+	// Pool is the count of addresses in the prefix which belong to this pool
+	Pool int64 `json:"pool"`
+}
+
+// IPPoolConditionType is a valid value for IPPoolCondition.Type
+type IPPoolConditionType string
+
+const (
+	// DriverReachable means the external IPAM service of the pool can be reached
+	DriverReachable IPPoolConditionType = "DriverReachable"
+	// Drifted means the last sync found the pool and the external IPAM
+	// service disagree
+	Drifted IPPoolConditionType = "Drifted"
+)
+
+// IPPoolCondition describes the state of an IPPool at a certain point
+type IPPoolCondition struct {
+	// Type of the condition
+	Type IPPoolConditionType `json:"type"`
+
+	// Status of the condition, one of True, False, Unknown
+	Status corev1.ConditionStatus `json:"status"`
+
+	// LastTransitionTime is the last time the condition changed its status
+	// +kubebuilder:validation:Optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// Reason is a brief CamelCase reason for the last transition
+	// +kubebuilder:validation:Optional
+	Reason string `json:"reason,omitempty"`
+
+	// Message is a human readable message about the last transition
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
 }
 
 // IPPoolStatus defines the observed state of IPPool
 type IPPoolStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// Prefixes is the utilization of each prefix backing the pool, reported
+	// by drivers which support it
+	// +kubebuilder:validation:Optional
+	Prefixes []PrefixUsage `json:"prefixes,omitempty"`
+
+	// Conditions is the current state of the pool
+	// +kubebuilder:validation:Optional
+	Conditions []IPPoolCondition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -2,21 +2,22 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
 	"github.com/jbliao/kubeipam/pkg/cni"
 	"github.com/jbliao/kubeipam/pkg/cni/allocator"
 	"github.com/jbliao/kubeipam/pkg/cni/pool"
-	multustypes "gopkg.in/intel/multus-cni.v3/types"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 func main() {
@@ -34,9 +35,7 @@ func loadNetConf(bytes []byte) (*cni.PluginConf, error) {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
 
-	if conf.IPAM.KubeConfigPath == "" ||
-		conf.IPAM.PoolName == "" ||
-		conf.IPAM.PoolNamespace == "" {
+	if conf.IPAM.KubeConfigPath == "" {
 		return nil, fmt.Errorf("K8s API Config not given, Please check the cni ipam config")
 	}
 	return conf, nil
@@ -52,6 +51,84 @@ func setupLog(logFile string) *log.Logger {
 	return log.New(log.Writer(), "", log.Flags()|log.Lshortfile)
 }
 
+// requestedIP return the address the pod asks for, from the runtimeConfig
+// ips, the IP of CNI_ARGS, or the annotation of the pod fetched by
+// SelectForPod, in this order. nil is returned if none is given. Only one
+// address can be requested, as only one is allocated.
+func requestedIP(conf *cni.PluginConf, k8sArgs *cni.K8sArgs,
+	p *pool.KubeIPAMPool) (net.IP, error) {
+	if len(conf.RuntimeConfig.IPs) > 1 {
+		return nil, fmt.Errorf("%d ips requested by runtimeConfig, only one is supported",
+			len(conf.RuntimeConfig.IPs))
+	}
+	if len(conf.RuntimeConfig.IPs) == 1 {
+		return cni.ParseRequestedIP(conf.RuntimeConfig.IPs[0])
+	}
+	if k8sArgs.IP != "" {
+		return cni.ParseRequestedIP(string(k8sArgs.IP))
+	}
+	if raw, ok := p.PodAnnotations()[cni.RequestedIPAnnotation]; ok {
+		return cni.ParseRequestedIP(raw)
+	}
+	return nil, nil
+}
+
+// allocate give the pod of info an address of the pool in use of p, the
+// requested one if not nil, or else one chosen by the allocation strategy
+func allocate(conf *cni.IPAMConf, p *pool.KubeIPAMPool, info *ippoolv1alpha1.IPAllocation,
+	requested net.IP, waitTimeout time.Duration, logger *log.Logger) (pool.Address, error) {
+	if requested != nil {
+		logger.Println("Allocating requested ip", requested, "for", *info)
+		return allocator.AllocateRequested(p, info, requested, logger)
+	}
+
+	strategy := ippoolv1alpha1.AllocationStrategy(conf.AllocationStrategy)
+	if strategy == "" {
+		var err error
+		if strategy, err = p.AllocationStrategy(); err != nil {
+			return nil, err
+		}
+	}
+	alctr, err := allocator.New(strategy, logger)
+	if err != nil {
+		return nil, err
+	}
+	logger.Println("Allocating ip for", *info)
+	return allocator.AllocateWaiting(alctr, p, info, waitTimeout, logger)
+}
+
+// fallible report whether err of a pool let the next pool be tried
+func fallible(err error) bool {
+	return apierrors.IsNotFound(err) ||
+		errors.Is(err, allocator.ErrPoolExhausted) ||
+		errors.Is(err, allocator.ErrNotInPool)
+}
+
+// allocateInOrder try the candidate pools of p in order, falling back to the
+// next one if a pool is missing, exhausted, or lacks the requested address.
+// Only the last pool is waited for to grow.
+func allocateInOrder(conf *cni.IPAMConf, p *pool.KubeIPAMPool, info *ippoolv1alpha1.IPAllocation,
+	requested net.IP, waitTimeout time.Duration, logger *log.Logger) (pool.Address, error) {
+	refs, err := p.Candidates()
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no pool given by pod, namespace or cni config")
+	}
+	last := len(refs) - 1
+	for _, ref := range refs[:last] {
+		p.Use(ref)
+		addr, err := allocate(conf, p, info, requested, 0, logger)
+		if err == nil || !fallible(err) {
+			return addr, err
+		}
+		logger.Printf("Pool %s unusable, trying next: %v", ref, err)
+	}
+	p.Use(refs[last])
+	return allocate(conf, p, info, requested, waitTimeout, logger)
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
 	conf, err := loadNetConf(args.StdinData)
 	if err != nil {
@@ -60,16 +137,31 @@ func cmdAdd(args *skel.CmdArgs) error {
 	logger := setupLog(conf.IPAM.LogFile)
 	logger.Printf("cmdAdd begin")
 
-	k8sArgs := &multustypes.K8sArgs{}
-	types.LoadArgs(args.Args, k8sArgs)
+	k8sArgs, err := cni.LoadK8sArgs(args.Args)
+	if err != nil {
+		logger.Println(err)
+		return err
+	}
 
 	pool, err := pool.NewKubeIPAMPool(&conf.IPAM, logger)
 	if err != nil {
 		logger.Println(err)
 		return err
 	}
+	if err = pool.SelectForPod(string(k8sArgs.K8S_POD_NAMESPACE),
+		string(k8sArgs.K8S_POD_NAME)); err != nil {
+		logger.Println(err)
+		return err
+	}
+	// the node is only needed by pools with a NodeSelector, which fail
+	// without it
+	nodeName, err := cni.NodeName(args.Args)
+	if err != nil {
+		logger.Println(err)
+	}
+	pool.SetNode(nodeName)
 
-	alctr, err := allocator.NewBasicAllocator(logger)
+	requested, err := requestedIP(conf, k8sArgs, pool)
 	if err != nil {
 		logger.Println(err)
 		return err
@@ -81,52 +173,35 @@ func cmdAdd(args *skel.CmdArgs) error {
 		PodNamespace: (string)(k8sArgs.K8S_POD_NAMESPACE),
 		ContainerID:  args.ContainerID,
 	}
-	logger.Println("Allocating ip for", *info)
-	ip, err := alctr.Allocate(pool, info)
+	var waitTimeout time.Duration
+	if conf.IPAM.WaitTimeout != "" {
+		if waitTimeout, err = time.ParseDuration(conf.IPAM.WaitTimeout); err != nil {
+			logger.Println(err)
+			return err
+		}
+	}
+
+	ip, err := allocateInOrder(&conf.IPAM, pool, info, requested, waitTimeout, logger)
 	if err != nil {
 		logger.Println(err)
 		return err
 	}
 
-	logger.Println("Get ip from allocator", ip)
-
-	tmp := net.ParseIP(conf.IPAM.Mask)
-	if tmp == nil {
+	logger.Println("Get ip from allocator", ip, "of pool", pool.Ref())
+	if err = conf.IPAM.RecordPool(args.ContainerID, pool.Ref()); err != nil {
+		// DEL looks for the pool without the record, only slower
 		logger.Println(err)
-		return err
 	}
-	tmp = tmp.To4()
 
-	gw := net.ParseIP(conf.IPAM.Gateway)
-	routes := []*types.Route{{
-		Dst: net.IPNet{
-			IP:   net.IPv4(0, 0, 0, 0),
-			Mask: net.CIDRMask(0, 32),
-		},
-		GW: gw,
-	}}
-
-	for _, rawRoute := range conf.IPAM.Routes {
-		_, ipnet, err := net.ParseCIDR(rawRoute)
-		if err != nil {
-			return err
-		}
-		routes = append(routes, &types.Route{
-			Dst: *ipnet,
-			GW:  gw,
-		})
+	network, err := pool.Network()
+	if err != nil {
+		logger.Println(err)
+		return err
 	}
-
-	result := &current.Result{
-		IPs: []*current.IPConfig{{
-			Version: "4",
-			Address: net.IPNet{
-				IP:   ip.NetIP(),
-				Mask: net.IPv4Mask(tmp[0], tmp[1], tmp[2], tmp[3]),
-			},
-			Gateway: net.ParseIP(conf.IPAM.Gateway),
-		}},
-		Routes: routes,
+	result, err := cni.BuildResult(ip.NetIP(), network, &conf.IPAM)
+	if err != nil {
+		logger.Println(err)
+		return err
 	}
 
 	logger.Printf("cmdAdd end %v", result)
@@ -142,11 +217,23 @@ func cmdDel(args *skel.CmdArgs) error {
 	logger := setupLog(conf.IPAM.LogFile)
 	logger.Printf("cmdDel begin")
 
+	k8sArgs, err := cni.LoadK8sArgs(args.Args)
+	if err != nil {
+		// the pod is only used to find its pool, UseHolder finds it anyway
+		logger.Println(err)
+		k8sArgs = &cni.K8sArgs{}
+	}
+
 	pool, err := pool.NewKubeIPAMPool(&conf.IPAM, logger)
 	if err != nil {
 		logger.Println(err)
 		return err
 	}
+	if err = pool.SelectForPod(string(k8sArgs.K8S_POD_NAMESPACE),
+		string(k8sArgs.K8S_POD_NAME)); err != nil {
+		// no selection, UseHolder looks for the holder in the pools of config
+		logger.Printf("no pool selected for pod: %v", err)
+	}
 
 	alctr, err := allocator.NewBasicAllocator(logger)
 	if err != nil {
@@ -154,9 +241,25 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	found, err := pool.UseHolder(args.ContainerID)
+	if err != nil {
+		logger.Println(err)
+		return err
+	}
+	if !found {
+		logger.Printf("no pool holds container %s", args.ContainerID)
+		if err = conf.IPAM.ForgetPool(args.ContainerID); err != nil {
+			logger.Println(err)
+		}
+		logger.Printf("cmdDel end")
+		return nil
+	}
+
 	err = alctr.Release(pool, args.ContainerID)
 	if err != nil {
 		logger.Printf("release with err: %v", err)
+	} else if forgetErr := conf.IPAM.ForgetPool(args.ContainerID); forgetErr != nil {
+		logger.Println(forgetErr)
 	}
 
 	logger.Printf("cmdDel end")
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/jbliao/kubeipam/pkg/crd/driver"
+	"github.com/jbliao/kubeipam/pkg/crd/driver/plugin"
+)
+
+// refsDir is the directory the Secrets and ConfigMaps referred by pool
+// configs are mounted in, as <refsDir>/<name>/<key>
+var refsDir string
+
+// readRef read ref from the files mounted in refsDir
+func readRef(ref *driver.NetboxKeyRef) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(refsDir, ref.Name, ref.Key))
+}
+
+// netboxFactory build the in-tree NetboxDriver from the raw pool config
+func netboxFactory(rawConfig string) (driver.Driver, error) {
+	config := &driver.NetboxDriverConfig{}
+	if err := json.Unmarshal([]byte(rawConfig), config); err != nil {
+		return nil, err
+	}
+	if err := config.ResolveRefs(readRef); err != nil {
+		return nil, err
+	}
+	return driver.NewNetboxDriver(config)
+}
+
+func main() {
+	var socket string
+	flag.StringVar(&socket, "socket", "/var/run/kubeipam/netbox-plugin.sock",
+		"The unix socket the plugin listens on. IPPools of type \"netbox-plugin\" "+
+			"are served by it when the manager runs with --driver-plugin-dir=/var/run/kubeipam.")
+	flag.StringVar(&refsDir, "refs-dir", "/etc/kubeipam/refs",
+		"The directory that Secrets and ConfigMaps referred by pool configs are mounted in.")
+	flag.Parse()
+
+	logger := log.New(log.Writer(), "", log.Flags()|log.Lshortfile)
+
+	// remove the socket left by previous run
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		logger.Fatalln(err)
+	}
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	server, err := plugin.NewServer(netboxFactory, logger)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	if err := server.Serve(lis); err != nil {
+		logger.Fatalln(err)
+	}
+}
@@ -19,17 +19,31 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	ipamv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
 	"github.com/jbliao/kubeipam/pkg/crd/driver"
+	"github.com/jbliao/kubeipam/pkg/crd/driver/plugin"
 )
 
 // IPPoolReconciler reconciles a IPPool object
@@ -37,24 +51,183 @@ type IPPoolReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// APIReader read the Secrets and ConfigMaps refered by pools, uncached
+	// so that they are neither listed nor watched across the cluster. The
+	// Client is used if unset.
+	APIReader client.Reader
+
+	// Recorder, if set, record an event for each drift found by sync
+	Recorder record.EventRecorder
+
+	// PluginDir is the directory that driver plugins listen in. A pool with
+	// type t which is not built in is served by the plugin at PluginDir/t.sock
+	PluginDir string
+
+	// ResyncPeriod is how long a synced pool waits for the next sync,
+	// default to 30s. Events, if set, queue pools for sync at once, e.g.
+	// from NetboxWebhook.
+	ResyncPeriod time.Duration
+	Events       <-chan event.GenericEvent
+
+	pluginLock  sync.Mutex
+	pluginConns map[string]*grpc.ClientConn
+
+	trackerLock sync.Mutex
+	trackers    map[types.NamespacedName]*driver.DemandTracker
+}
+
+// resyncPeriod return ResyncPeriod, or the default if unset
+func (r *IPPoolReconciler) resyncPeriod() time.Duration {
+	if r.ResyncPeriod > 0 {
+		return r.ResyncPeriod
+	}
+	return 30 * time.Second
+}
+
+// demand return the count of addresses expected to be allocated before the
+// next resync, which is the pending claims of pool, plus the prediction from
+// its allocations if pool wants it
+func (r *IPPoolReconciler) demand(pool *ipamv1alpha1.IPPool) int {
+	pending := len(pool.PendingClaims(time.Now()))
+
+	key := types.NamespacedName{Namespace: pool.Namespace, Name: pool.Name}
+	r.trackerLock.Lock()
+	tracker, ok := r.trackers[key]
+	if pool.Spec.PredictWindow == nil {
+		delete(r.trackers, key)
+		r.trackerLock.Unlock()
+		return pending
+	}
+	if !ok || tracker.Window != pool.Spec.PredictWindow.Duration {
+		tracker = &driver.DemandTracker{Window: pool.Spec.PredictWindow.Duration}
+		if r.trackers == nil {
+			r.trackers = map[types.NamespacedName]*driver.DemandTracker{}
+		}
+		r.trackers[key] = tracker
+	}
+	r.trackerLock.Unlock()
+
+	tracker.Observe(pool.Spec.Allocations, time.Now())
+	return pending + tracker.Demand(r.resyncPeriod())
 }
 
-func (r *IPPoolReconciler) getDriver(driverType string, rawConfig string) (d driver.Driver, err error) {
-	switch t := driverType; t {
+// forgetDemand drop the tracker of the deleted pool key
+func (r *IPPoolReconciler) forgetDemand(key types.NamespacedName) {
+	r.trackerLock.Lock()
+	defer r.trackerLock.Unlock()
+	delete(r.trackers, key)
+}
+
+// getPluginConn return the cached connection to the plugin serving driverType
+func (r *IPPoolReconciler) getPluginConn(driverType string) (*grpc.ClientConn, error) {
+	if r.PluginDir == "" {
+		return nil, fmt.Errorf("Type %s not implemented", driverType)
+	}
+	endpoint := filepath.Join(r.PluginDir, driverType+".sock")
+	if _, err := os.Stat(endpoint); err != nil {
+		return nil, fmt.Errorf("Type %s not implemented: %v", driverType, err)
+	}
+
+	r.pluginLock.Lock()
+	defer r.pluginLock.Unlock()
+	if conn, ok := r.pluginConns[endpoint]; ok {
+		return conn, nil
+	}
+	conn, err := plugin.Dial(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if r.pluginConns == nil {
+		r.pluginConns = map[string]*grpc.ClientConn{}
+	}
+	r.pluginConns[endpoint] = conn
+	return conn, nil
+}
+
+// keyRefGetter return a getter which read the refs from Secrets and
+// ConfigMaps in namespace
+func (r *IPPoolReconciler) keyRefGetter(ctx context.Context, namespace string) driver.KeyRefGetter {
+	var reader client.Reader = r.Client
+	if r.APIReader != nil {
+		reader = r.APIReader
+	}
+	return func(ref *driver.NetboxKeyRef) ([]byte, error) {
+		key := types.NamespacedName{Namespace: namespace, Name: ref.Name}
+		switch ref.Kind {
+		case "", "Secret":
+			secret := &corev1.Secret{}
+			if err := reader.Get(ctx, key, secret); err != nil {
+				return nil, err
+			}
+			if data, ok := secret.Data[ref.Key]; ok {
+				return data, nil
+			}
+		case "ConfigMap":
+			configMap := &corev1.ConfigMap{}
+			if err := reader.Get(ctx, key, configMap); err != nil {
+				return nil, err
+			}
+			if data, ok := configMap.Data[ref.Key]; ok {
+				return []byte(data), nil
+			}
+		default:
+			return nil, fmt.Errorf("unknown kind %s of ref %s", ref.Kind, ref.Name)
+		}
+		return nil, fmt.Errorf("key %s not found in %s %s", ref.Key, ref.Kind, key)
+	}
+}
+
+// forgetPool tell every plugin connected to drop the driver of the deleted
+// pool key
+func (r *IPPoolReconciler) forgetPool(key types.NamespacedName) {
+	r.pluginLock.Lock()
+	conns := []*grpc.ClientConn{}
+	for _, conn := range r.pluginConns {
+		conns = append(conns, conn)
+	}
+	r.pluginLock.Unlock()
+
+	for _, conn := range conns {
+		c, err := plugin.NewClient(conn, key.Namespace, "")
+		if err != nil {
+			continue
+		}
+		c.SetPoolID(key.Name)
+		if err := c.Forget(); err != nil && !errors.Is(err, driver.ErrUnsupported) {
+			r.Log.Error(err, "cannot forget pool in plugin", "ippool", key)
+		}
+	}
+}
+
+func (r *IPPoolReconciler) getDriver(ctx context.Context, pool *ipamv1alpha1.IPPool) (d driver.Driver, err error) {
+	rawConfig := pool.Spec.RawConfig
+	switch t := pool.Spec.Type; t {
 	case "netbox":
 		config := &driver.NetboxDriverConfig{}
 		if err = json.Unmarshal([]byte(rawConfig), &config); err != nil {
 			return
 		}
+		if err = config.ResolveRefs(r.keyRefGetter(ctx, pool.Namespace)); err != nil {
+			return
+		}
 		d, err = driver.NewNetboxDriver(config)
 	default:
-		d, err = nil, fmt.Errorf("Type %s not implemented", t)
+		var conn *grpc.ClientConn
+		if conn, err = r.getPluginConn(t); err != nil {
+			return
+		}
+		d, err = plugin.NewClient(conn, pool.Namespace, rawConfig)
 	}
 	return
 }
 
 // +kubebuilder:rbac:groups=ipam.k8s.cc.cs.nctu.edu.tw,resources=ippools,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=ipam.k8s.cc.cs.nctu.edu.tw,resources=ippools/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=secrets;configmaps,verbs=get
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch
 
 // Reconcile ...
 func (r *IPPoolReconciler) Reconcile(req ctrl.Request) (res ctrl.Result, err error) {
@@ -68,33 +241,93 @@ func (r *IPPoolReconciler) Reconcile(req ctrl.Request) (res ctrl.Result, err err
 
 	pool := &ipamv1alpha1.IPPool{}
 	if err = r.Get(ctx, req.NamespacedName, pool); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.forgetPool(req.NamespacedName)
+			r.forgetDemand(req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
 		return
 	}
 
-	driverObj, err := r.getDriver(pool.Spec.Type, pool.Spec.RawConfig)
+	driverObj, err := r.getDriver(ctx, pool)
+	if err != nil {
+		logger.Error(err, "")
+		return
+	}
 	driverObj.SetPoolID(pool.Name)
 	driverObj.SetLogger(gologger)
 
-	if err = driver.Sync(driverObj, &pool.Spec, gologger); err != nil {
+	pool.Spec.SweepCooling(time.Now())
+	if err = r.sweepReservations(ctx, pool); err != nil {
 		logger.Error(err, "")
 		return
 	}
 
+	// Sync may leave spec half done on error, only the status of the
+	// original is updated then
+	orig := pool.DeepCopy()
+	drifts, err := driver.Sync(driverObj, &pool.Spec, r.demand(pool), gologger)
+	if err != nil {
+		logger.Error(err, "")
+		if errors.Is(err, driver.ErrDriverUnreachable) {
+			orig.Status.SetCondition(ipamv1alpha1.DriverReachable,
+				corev1.ConditionFalse, "Unreachable", err.Error())
+			if updateErr := r.Update(ctx, orig); updateErr != nil {
+				logger.Error(updateErr, "")
+			}
+		}
+		return
+	}
+	pool.Status.SetCondition(ipamv1alpha1.DriverReachable,
+		corev1.ConditionTrue, "Synced", "")
+	r.reportDrifts(pool, drifts)
+
+	if reporter, ok := driverObj.(driver.UsageReporter); ok {
+		pool.Status.Prefixes = reporter.Usage()
+	}
+
 	if err = r.Update(ctx, pool); err != nil {
 		logger.Error(err, "")
 		return
 	}
 
-	// if success, resync after 30 sec
-	dur, _ = time.ParseDuration("30s")
-	res = ctrl.Result{RequeueAfter: dur}
+	// if success, resync after ResyncPeriod
+	res = ctrl.Result{RequeueAfter: r.resyncPeriod()}
 	return
 
 }
 
+// reportDrifts record an event for each drift and set the Drifted condition
+func (r *IPPoolReconciler) reportDrifts(pool *ipamv1alpha1.IPPool, drifts []driver.Drift) {
+	if len(drifts) == 0 {
+		pool.Status.SetCondition(ipamv1alpha1.Drifted,
+			corev1.ConditionFalse, "InSync", "")
+		return
+	}
+
+	policy := pool.Spec.DriftPolicy
+	if policy == "" {
+		policy = ipamv1alpha1.DriftPolicyWarn
+	}
+	messages := []string{}
+	for _, drift := range drifts {
+		messages = append(messages, drift.String())
+		if r.Recorder != nil {
+			r.Recorder.Eventf(pool, corev1.EventTypeWarning, "Drift"+string(drift.Kind),
+				"%s, policy %s", drift, policy)
+		}
+	}
+	pool.Status.SetCondition(ipamv1alpha1.Drifted, corev1.ConditionTrue,
+		string(policy), strings.Join(messages, "; "))
+}
+
 // SetupWithManager ...
 func (r *IPPoolReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&ipamv1alpha1.IPPool{}).
-		Complete(r)
+	builder := ctrl.NewControllerManagedBy(mgr).
+		For(&ipamv1alpha1.IPPool{})
+	if r.Events != nil {
+		builder = builder.Watches(&source.Channel{Source: r.Events},
+			&handler.EnqueueRequestForObject{})
+	}
+	return builder.Complete(r)
 }
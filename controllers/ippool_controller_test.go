@@ -0,0 +1,63 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ipamv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+// newTestReconciler build a reconciler on a fake client holding objs
+func newTestReconciler(objs ...runtime.Object) *IPPoolReconciler {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = ipamv1alpha1.AddToScheme(scheme)
+	return &IPPoolReconciler{
+		Client: fake.NewFakeClientWithScheme(scheme, objs...),
+		Log:    ctrl.Log.WithName("test"),
+		Scheme: scheme,
+	}
+}
+
+func TestReconcileForgetsDeletedPool(t *testing.T) {
+	r := newTestReconciler()
+	pool := &ipamv1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "gone"},
+		Spec:       ipamv1alpha1.IPPoolSpec{PredictWindow: &metav1.Duration{Duration: time.Minute}},
+	}
+	r.demand(pool)
+	if len(r.trackers) != 1 {
+		t.Fatalf("expect a tracker of pool, got %v", r.trackers)
+	}
+
+	res, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "gone"}})
+	if err != nil || res.RequeueAfter != 0 {
+		t.Errorf("expect a deleted pool done with, got %v %v", res, err)
+	}
+	if len(r.trackers) != 0 {
+		t.Errorf("expect the tracker of deleted pool dropped, got %v", r.trackers)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	ipamv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+// statefulSetOrdinal split the name of a StatefulSet pod into the name of
+// StatefulSet and the ordinal, which is written in decimal without sign or
+// leading zeros
+func statefulSetOrdinal(podName string) (string, int, bool) {
+	idx := strings.LastIndex(podName, "-")
+	if idx <= 0 || strings.HasSuffix(podName[:idx], "-") {
+		return "", 0, false
+	}
+	ordinal, err := strconv.Atoi(podName[idx+1:])
+	if err != nil || ordinal < 0 || strconv.Itoa(ordinal) != podName[idx+1:] {
+		return "", 0, false
+	}
+	return podName[:idx], ordinal, true
+}
+
+// reservationWanted report whether the pod of rsv may still come back: it
+// exists, or it is a replica of a StatefulSet which is not scaled down below it
+func (r *IPPoolReconciler) reservationWanted(ctx context.Context, rsv *ipamv1alpha1.IPReservation) (bool, error) {
+	pod := &corev1.Pod{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: rsv.PodNamespace, Name: rsv.PodName}, pod)
+	if err == nil {
+		return true, nil
+	} else if !apierrors.IsNotFound(err) {
+		return false, err
+	}
+
+	name, ordinal, ok := statefulSetOrdinal(rsv.PodName)
+	if !ok {
+		return false, nil
+	}
+	sts := &appsv1.StatefulSet{}
+	err = r.Get(ctx, types.NamespacedName{Namespace: rsv.PodNamespace, Name: name}, sts)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	return int32(ordinal) < replicas, nil
+}
+
+// sweepReservations drop the reservations of pods gone for good, whose
+// addresses are released as if by the pods, and the reservations of
+// addresses no longer in pool
+func (r *IPPoolReconciler) sweepReservations(ctx context.Context, pool *ipamv1alpha1.IPPool) error {
+	inPool := map[string]bool{}
+	for _, addr := range pool.Spec.Addresses {
+		inPool[addr] = true
+	}
+
+	now := time.Now()
+	kept := []ipamv1alpha1.IPReservation{}
+	for idx := range pool.Spec.Reservations {
+		rsv := &pool.Spec.Reservations[idx]
+		wanted, err := r.reservationWanted(ctx, rsv)
+		if err != nil {
+			return err
+		}
+		if wanted && inPool[rsv.Address] {
+			kept = append(kept, *rsv)
+			continue
+		}
+		r.Log.Info("free reservation", "address", rsv.Address,
+			"pod", rsv.PodNamespace+"/"+rsv.PodName)
+		if inPool[rsv.Address] {
+			pool.Spec.RecordRelease(rsv.Address, now)
+		}
+	}
+	if len(kept) == 0 {
+		kept = nil
+	}
+	pool.Spec.Reservations = kept
+	return nil
+}
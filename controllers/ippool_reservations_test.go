@@ -0,0 +1,130 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	ipamv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+func TestStatefulSetOrdinal(t *testing.T) {
+	tests := []struct {
+		podName string
+		name    string
+		ordinal int
+		ok      bool
+	}{
+		{"web-0", "web", 0, true},
+		{"my-db-12", "my-db", 12, true},
+		{"web", "", 0, false},
+		{"-3", "", 0, false},
+		{"web-", "", 0, false},
+		{"web-abc12", "", 0, false},
+		{"web--1", "", 0, false},
+		{"web-+1", "", 0, false},
+		{"web-01", "", 0, false},
+		{"web-5b8f7c9d4-x2x7k", "", 0, false},
+	}
+	for _, test := range tests {
+		name, ordinal, ok := statefulSetOrdinal(test.podName)
+		if name != test.name || ordinal != test.ordinal || ok != test.ok {
+			t.Errorf("%s: expect %q %d %v, got %q %d %v", test.podName,
+				test.name, test.ordinal, test.ok, name, ordinal, ok)
+		}
+	}
+}
+
+func TestSweepReservations(t *testing.T) {
+	replicas := int32(3)
+	objs := []runtime.Object{
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "live"}},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+		},
+	}
+
+	tests := []struct {
+		pod     string
+		address string
+		kept    bool
+		cooling bool
+	}{
+		// the pod is alive
+		{"live", "10.0.0.1", true, false},
+		// the pod is deleted and no StatefulSet brings it back
+		{"deleted", "10.0.0.2", false, true},
+		// the replica is recreated by its StatefulSet
+		{"db-2", "10.0.0.3", true, false},
+		// the StatefulSet is scaled down below the replica
+		{"db-3", "10.0.0.4", false, true},
+		// the StatefulSet is deleted
+		{"gone-0", "10.0.0.5", false, true},
+		// the address left the pool, so it is not released either
+		{"live", "10.9.9.9", false, false},
+	}
+	for _, test := range tests {
+		r := newTestReconciler(objs...)
+		pool := &ipamv1alpha1.IPPool{Spec: ipamv1alpha1.IPPoolSpec{
+			Addresses:       []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"},
+			ReleaseCooldown: &metav1.Duration{Duration: time.Minute},
+		}}
+		pool.Spec.Reserve(test.address, "default", test.pod)
+
+		if err := r.sweepReservations(context.Background(), pool); err != nil {
+			t.Errorf("%s: %v", test.pod, err)
+			continue
+		}
+		kept := pool.Spec.Reservations != nil
+		if kept != test.kept {
+			t.Errorf("%s: expect kept %v, got %v", test.pod, test.kept, pool.Spec.Reservations)
+		}
+		if cooling := pool.Spec.IsCooling(test.address, time.Now()); cooling != test.cooling {
+			t.Errorf("%s: expect cooling %v, got %v", test.pod, test.cooling, pool.Spec.Cooling)
+		}
+		_, released := pool.Spec.Releases[test.address]
+		if released != test.cooling {
+			t.Errorf("%s: expect release recorded %v, got %v", test.pod, test.cooling, pool.Spec.Releases)
+		}
+	}
+
+	// reservations are kept in order
+	r := newTestReconciler(objs...)
+	pool := &ipamv1alpha1.IPPool{Spec: ipamv1alpha1.IPPoolSpec{Addresses: []string{"10.0.0.1", "10.0.0.3"}}}
+	pool.Spec.Reserve("10.0.0.3", "default", "db-2")
+	pool.Spec.Reserve("10.0.0.1", "default", "live")
+	pool.Spec.Reserve("10.0.0.2", "default", "deleted")
+	if err := r.sweepReservations(context.Background(), pool); err != nil {
+		t.Fatal(err)
+	}
+	expect := []ipamv1alpha1.IPReservation{
+		{Address: "10.0.0.3", PodNamespace: "default", PodName: "db-2"},
+		{Address: "10.0.0.1", PodNamespace: "default", PodName: "live"},
+	}
+	if !reflect.DeepEqual(pool.Spec.Reservations, expect) {
+		t.Errorf("expect %v, got %v", expect, pool.Spec.Reservations)
+	}
+}
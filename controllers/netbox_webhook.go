@@ -0,0 +1,123 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	ipamv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+	"github.com/jbliao/kubeipam/pkg/crd/driver"
+)
+
+// maxWebhookBody bounds the size of webhook body read
+const maxWebhookBody = 1 << 20
+
+// NetboxWebhook receive the ip address webhooks of netbox and send the pools
+// owning the address to Events, for them to be reconciled at once. The pools
+// of every driver type are queued, e.g. the ones of a netbox plugin. An event
+// which does not fit in Events is dropped, the pool is synced by its resync
+// anyway.
+type NetboxWebhook struct {
+	client.Reader
+	Log logr.Logger
+
+	// Secret is the secret configured on the netbox webhook, the requests
+	// without its signature are refused. It must not be empty.
+	Secret string
+	// Addr is the address the webhook listen on
+	Addr string
+
+	Events chan<- event.GenericEvent
+}
+
+// ServeHTTP impl http.Handler
+func (h *NetboxWebhook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxWebhookBody))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	signature := req.Header.Get(driver.NetboxWebhookSignatureHeader)
+	if !driver.VerifyNetboxSignature(body, signature, h.Secret) {
+		h.Log.Info("refused webhook with bad signature", "remote", req.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	names, err := driver.ParseNetboxWebhook(body)
+	if err != nil {
+		h.Log.Error(err, "cannot parse webhook")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	// the pool tag carries no namespace, every pool with the name is queued
+	pools := &ipamv1alpha1.IPPoolList{}
+	if err := h.List(req.Context(), pools); err != nil {
+		h.Log.Error(err, "cannot list pools")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, name := range names {
+		for idx := range pools.Items {
+			pool := &pools.Items[idx]
+			if pool.Name != name {
+				continue
+			}
+			select {
+			case h.Events <- event.GenericEvent{Meta: pool, Object: pool}:
+				h.Log.Info("queue pool by webhook", "ippool", pool.Namespace+"/"+pool.Name)
+			default:
+				h.Log.Info("queue full, pool left to resync", "ippool", pool.Namespace+"/"+pool.Name)
+			}
+		}
+	}
+}
+
+// Start serve the webhook on Addr until stop is closed, impl manager.Runnable
+func (h *NetboxWebhook) Start(stop <-chan struct{}) error {
+	if h.Secret == "" {
+		return fmt.Errorf("netbox webhook secret is empty")
+	}
+	server := &http.Server{Addr: h.Addr, Handler: h}
+	go func() {
+		<-stop
+		server.Shutdown(context.Background())
+	}()
+	h.Log.Info("serving netbox webhook", "addr", h.Addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+var _ manager.Runnable = &NetboxWebhook{}
@@ -7,10 +7,16 @@ require (
 	github.com/containernetworking/plugins v0.8.5
 	github.com/go-logr/logr v0.1.0
 	github.com/go-openapi/runtime v0.19.15
+	github.com/go-openapi/strfmt v0.19.5
+	github.com/golang/groupcache v0.0.0-20190702054246-869f871628b6 // indirect
+	github.com/json-iterator/go v1.1.9 // indirect
 	github.com/netbox-community/go-netbox v0.0.0-20200507032154-fbb6900a912a
 	github.com/onsi/ginkgo v1.12.0
 	github.com/onsi/gomega v1.10.0
-	gopkg.in/intel/multus-cni.v3 v3.4.2
+	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b // indirect
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	google.golang.org/grpc v1.26.0
+	k8s.io/api v0.18.2
 	k8s.io/apimachinery v0.18.2
 	k8s.io/client-go v0.18.2
 	sigs.k8s.io/controller-runtime v0.6.0
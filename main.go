@@ -18,12 +18,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	ipamv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
@@ -31,6 +36,10 @@ import (
 	// +kubebuilder:scaffold:imports
 )
 
+// webhookQueueSize is how many pools queued by webhook wait for the
+// controller before more are dropped
+const webhookQueueSize = 128
+
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
@@ -46,10 +55,22 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var pluginDir string
+	var resyncPeriod time.Duration
+	var webhookAddr, webhookSecretFile string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&pluginDir, "driver-plugin-dir", "",
+		"The directory that out-of-process driver plugins listen in. "+
+			"An IPPool of a type not built in uses the plugin socket <dir>/<type>.sock.")
+	flag.DurationVar(&resyncPeriod, "resync-period", 30*time.Second,
+		"How long a synced IPPool waits before it is synced again.")
+	flag.StringVar(&webhookAddr, "netbox-webhook-addr", "",
+		"The address the netbox webhook receiver binds to. Disabled if empty.")
+	flag.StringVar(&webhookSecretFile, "netbox-webhook-secret-file", "",
+		"The file containing the secret configured on the netbox webhook.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
@@ -66,10 +87,42 @@ func main() {
 		os.Exit(1)
 	}
 
+	var events chan event.GenericEvent
+	if webhookAddr != "" {
+		raw, err := ioutil.ReadFile(webhookSecretFile)
+		if err != nil {
+			setupLog.Error(err, "unable to read netbox webhook secret")
+			os.Exit(1)
+		}
+		// an empty key would accept any body signed with it
+		secret := strings.TrimSpace(string(raw))
+		if secret == "" {
+			setupLog.Error(fmt.Errorf("empty secret in %s", webhookSecretFile),
+				"unable to read netbox webhook secret")
+			os.Exit(1)
+		}
+		events = make(chan event.GenericEvent, webhookQueueSize)
+		if err = mgr.Add(&controllers.NetboxWebhook{
+			Reader: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("webhooks").WithName("Netbox"),
+			Secret: secret,
+			Addr:   webhookAddr,
+			Events: events,
+		}); err != nil {
+			setupLog.Error(err, "unable to add netbox webhook")
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controllers.IPPoolReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("IPPool"),
-		Scheme: mgr.GetScheme(),
+		Client:       mgr.GetClient(),
+		APIReader:    mgr.GetAPIReader(),
+		Log:          ctrl.Log.WithName("controllers").WithName("IPPool"),
+		Scheme:       mgr.GetScheme(),
+		Recorder:     mgr.GetEventRecorderFor("ippool-controller"),
+		PluginDir:    pluginDir,
+		ResyncPeriod: resyncPeriod,
+		Events:       events,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "IPPool")
 		os.Exit(1)
@@ -0,0 +1,167 @@
+package allocator
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+	"github.com/jbliao/kubeipam/pkg/cni/pool"
+)
+
+// ErrPoolExhausted is returned when the pool has no free address
+var ErrPoolExhausted = errors.New("cannot allocate: pool exhausted")
+
+// ErrNotInPool is returned when the requested address is not in the pool
+var ErrNotInPool = errors.New("requested address is not in pool")
+
+// waitPollInterval is how often AllocateWaiting look at the pool again
+const waitPollInterval = time.Second
+
+// Allocator allocate the addresses of pool to containers
+type Allocator interface {
+	// Allocate choose a free address of pool and mark it allocated with info
+	Allocate(pool.Pool, *ippoolv1alpha1.IPAllocation) (pool.Address, error)
+	// Release the address allocated to containerID
+	Release(pool pool.Pool, containerID string) error
+}
+
+// New construct the allocator of strategy, BasicAllocator if it is empty
+func New(strategy ippoolv1alpha1.AllocationStrategy, logger *log.Logger) (Allocator, error) {
+	basic, err := NewBasicAllocator(logger)
+	if err != nil {
+		return nil, err
+	}
+	switch strategy {
+	case "", ippoolv1alpha1.AllocationFirst:
+		return basic, nil
+	case ippoolv1alpha1.AllocationRandom:
+		return &RandomAllocator{BasicAllocator: basic}, nil
+	case ippoolv1alpha1.AllocationRoundRobin:
+		return &RoundRobinAllocator{BasicAllocator: basic}, nil
+	case ippoolv1alpha1.AllocationLeastRecentlyReleased:
+		return &LRUAllocator{BasicAllocator: basic}, nil
+	}
+	return nil, fmt.Errorf("unknown allocation strategy %s", strategy)
+}
+
+// allocable report whether addr is free, out of cooldown and not reserved
+func allocable(addr pool.Address) bool {
+	return !addr.Allocated() && !addr.Cooling() && !addr.Reserved()
+}
+
+// allocateWith mark the address pick choose among the addresses of pool
+// allocated. pick return nil if no address is free.
+func allocateWith(logger *log.Logger, p pool.Pool, info *ippoolv1alpha1.IPAllocation,
+	pick func([]pool.Address) pool.Address) (pool.Address, error) {
+	ipAddrLst, err := p.GetAddresses()
+	if err != nil {
+		return nil, err
+	}
+	logger.Println("Loop to find allocable address")
+	if ipAddr := pick(ipAddrLst); ipAddr != nil {
+		logger.Println("Found allocable address", ipAddr)
+		if err := p.MarkAddressAllocated(ipAddr, info); err != nil {
+			return nil, err
+		}
+		return ipAddr, nil
+	}
+	err = ErrPoolExhausted
+	logger.Println(err)
+	return nil, err
+}
+
+// AllocateRequested mark the address ip allocated to the pod of info, as
+// requested. It fails if ip is not in the pool or not free for the pod.
+func AllocateRequested(p pool.Pool, info *ippoolv1alpha1.IPAllocation,
+	ip net.IP, logger *log.Logger) (pool.Address, error) {
+	addrs, err := p.GetAddresses()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if !addr.NetIP().Equal(ip) {
+			continue
+		}
+		switch {
+		case addr.Allocated():
+			err = fmt.Errorf("requested address %s is allocated", ip)
+		case addr.Cooling():
+			err = fmt.Errorf("requested address %s is cooling down after release", ip)
+		case addr.Reserved() && !reservedFor(p, info, addr):
+			err = fmt.Errorf("requested address %s is reserved for another pod", ip)
+		}
+		if err != nil {
+			logger.Println(err)
+			return nil, err
+		}
+
+		logger.Println("Found requested address", addr)
+		info.Requested = true
+		if err := p.MarkAddressAllocated(addr, info); err != nil {
+			return nil, err
+		}
+		return addr, nil
+	}
+	err = fmt.Errorf("%w: %s", ErrNotInPool, ip)
+	logger.Println(err)
+	return nil, err
+}
+
+// reservedFor report whether addr is kept for the pod of info
+func reservedFor(p pool.Pool, info *ippoolv1alpha1.IPAllocation, addr pool.Address) bool {
+	sticky, ok := p.(pool.StickyPool)
+	if !ok {
+		return false
+	}
+	reserved, err := sticky.ReservedAddress(info)
+	return err == nil && reserved != nil && reserved.NetIP().Equal(addr.NetIP())
+}
+
+// AllocateWaiting give the pod of info the address kept for it if the pool
+// is sticky, or call a.Allocate. If the pool is exhausted but can grow, it
+// signal the demand and retry until timeout.
+func AllocateWaiting(a Allocator, p pool.Pool, info *ippoolv1alpha1.IPAllocation,
+	timeout time.Duration, logger *log.Logger) (pool.Address, error) {
+	if sticky, ok := p.(pool.StickyPool); ok {
+		addr, err := sticky.ReservedAddress(info)
+		if err != nil {
+			return nil, err
+		}
+		if addr != nil {
+			logger.Println("Found reserved address", addr)
+			if err := p.MarkAddressAllocated(addr, info); err != nil {
+				return nil, err
+			}
+			return addr, nil
+		}
+	}
+
+	addr, err := a.Allocate(p, info)
+	growable, ok := p.(pool.GrowablePool)
+	if err != ErrPoolExhausted || !ok || timeout <= 0 {
+		return addr, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	logger.Printf("Pool exhausted, waiting for it to grow until %v", deadline)
+	if err = growable.SignalDemand(info.ContainerID, deadline); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := growable.SignalDemand(info.ContainerID, time.Time{}); err != nil {
+			logger.Printf("cannot clear demand: %v", err)
+		}
+	}()
+
+	for time.Now().Before(deadline) {
+		time.Sleep(waitPollInterval)
+		growable.Refresh()
+		if addr, err = a.Allocate(p, info); err != ErrPoolExhausted {
+			return addr, err
+		}
+	}
+	return nil, fmt.Errorf("%w after waiting %v", ErrPoolExhausted, timeout)
+}
@@ -0,0 +1,164 @@
+package allocator
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+	"github.com/jbliao/kubeipam/pkg/cni/pool"
+)
+
+type fakeAddress struct {
+	net.IP
+	allocated   bool
+	allocatedAt time.Time
+	releasedAt  time.Time
+	cooling     bool
+	reserved    bool
+}
+
+func (a *fakeAddress) Allocated() bool        { return a.allocated }
+func (a *fakeAddress) NetIP() net.IP          { return a.IP }
+func (a *fakeAddress) AllocatedAt() time.Time { return a.allocatedAt }
+func (a *fakeAddress) ReleasedAt() time.Time  { return a.releasedAt }
+func (a *fakeAddress) Cooling() bool          { return a.cooling }
+func (a *fakeAddress) Reserved() bool         { return a.reserved }
+
+// fakePool grows by one address on the first refresh after demand signaled
+type fakePool struct {
+	addrs         []*fakeAddress
+	pending       map[string]time.Time
+	lastAllocated string
+}
+
+func (p *fakePool) GetAddresses() (ret []pool.Address, err error) {
+	for _, addr := range p.addrs {
+		ret = append(ret, addr)
+	}
+	return
+}
+
+func (p *fakePool) MarkAddressAllocated(addr pool.Address, info *ippoolv1alpha1.IPAllocation) error {
+	addr.(*fakeAddress).allocated = true
+	addr.(*fakeAddress).allocatedAt = time.Now()
+	p.lastAllocated = addr.String()
+	return nil
+}
+
+func (p *fakePool) MarkAddressReleased(containerID string) error { return nil }
+
+func (p *fakePool) LastAllocated() string { return p.lastAllocated }
+
+func (p *fakePool) SignalDemand(containerID string, until time.Time) error {
+	if until.IsZero() {
+		delete(p.pending, containerID)
+	} else {
+		p.pending[containerID] = until
+	}
+	return nil
+}
+
+func (p *fakePool) Refresh() {
+	if len(p.pending) > 0 {
+		p.addrs = append(p.addrs, &fakeAddress{IP: net.ParseIP("10.0.0.2")})
+	}
+}
+
+func TestAllocateWaiting(t *testing.T) {
+	alctr, _ := NewBasicAllocator(log.New(ioutil.Discard, "", 0))
+	p := &fakePool{
+		addrs:   []*fakeAddress{{IP: net.ParseIP("10.0.0.1"), allocated: true}},
+		pending: map[string]time.Time{},
+	}
+	info := &ippoolv1alpha1.IPAllocation{ContainerID: "c"}
+
+	if _, err := AllocateWaiting(alctr, p, info, 0, alctr.logger); err != ErrPoolExhausted {
+		t.Errorf("expect exhausted without waiting, got %v", err)
+	}
+
+	addr, err := AllocateWaiting(alctr, p, info, 5*time.Second, alctr.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "10.0.0.2" {
+		t.Errorf("expect the address pool grew with, got %s", addr)
+	}
+	if len(p.pending) != 0 {
+		t.Errorf("demand not cleared: %v", p.pending)
+	}
+}
+
+// fakeStickyPool keeps 10.0.0.2 for pod default/db-0
+type fakeStickyPool struct {
+	*fakePool
+}
+
+func (p *fakeStickyPool) ReservedAddress(info *ippoolv1alpha1.IPAllocation) (pool.Address, error) {
+	if info.PodNamespace == "default" && info.PodName == "db-0" {
+		return p.addrs[1], nil
+	}
+	return nil, nil
+}
+
+func TestAllocateSticky(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	alctr, _ := NewBasicAllocator(logger)
+	p := &fakeStickyPool{&fakePool{
+		addrs: []*fakeAddress{
+			{IP: net.ParseIP("10.0.0.1")},
+			{IP: net.ParseIP("10.0.0.2"), reserved: true},
+			{IP: net.ParseIP("10.0.0.3")},
+		},
+		pending: map[string]time.Time{},
+	}}
+
+	info := &ippoolv1alpha1.IPAllocation{PodNamespace: "default", PodName: "web-0"}
+	addr, err := AllocateWaiting(alctr, p, info, 0, logger)
+	if err != nil || addr.String() != "10.0.0.1" {
+		t.Errorf("expect first free address, got %v %v", addr, err)
+	}
+	addr, err = AllocateWaiting(alctr, p, info, 0, logger)
+	if err != nil || addr.String() != "10.0.0.3" {
+		t.Errorf("reserved address should be skipped, got %v %v", addr, err)
+	}
+
+	info = &ippoolv1alpha1.IPAllocation{PodNamespace: "default", PodName: "db-0"}
+	addr, err = AllocateWaiting(alctr, p, info, 0, logger)
+	if err != nil || addr.String() != "10.0.0.2" {
+		t.Errorf("expect the reserved address, got %v %v", addr, err)
+	}
+}
+
+func TestAllocateRequested(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	p := &fakeStickyPool{&fakePool{
+		addrs: []*fakeAddress{
+			{IP: net.ParseIP("10.0.0.1"), allocated: true},
+			{IP: net.ParseIP("10.0.0.2"), reserved: true},
+			{IP: net.ParseIP("10.0.0.3"), cooling: true},
+			{IP: net.ParseIP("10.0.0.4")},
+		},
+	}}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.9"} {
+		info := &ippoolv1alpha1.IPAllocation{PodNamespace: "default", PodName: "web-0"}
+		if addr, err := AllocateRequested(p, info, net.ParseIP(ip), logger); err == nil {
+			t.Errorf("expect %s refused, got %v", ip, addr)
+		}
+	}
+
+	info := &ippoolv1alpha1.IPAllocation{PodNamespace: "default", PodName: "web-0"}
+	addr, err := AllocateRequested(p, info, net.ParseIP("10.0.0.4"), logger)
+	if err != nil || addr.String() != "10.0.0.4" || !info.Requested {
+		t.Errorf("expect requested 10.0.0.4, got %v %v %v", addr, err, info.Requested)
+	}
+
+	info = &ippoolv1alpha1.IPAllocation{PodNamespace: "default", PodName: "db-0"}
+	addr, err = AllocateRequested(p, info, net.ParseIP("10.0.0.2"), logger)
+	if err != nil || addr.String() != "10.0.0.2" {
+		t.Errorf("expect the address reserved for the pod, got %v %v", addr, err)
+	}
+}
@@ -23,23 +23,17 @@ func NewBasicAllocator(logger *log.Logger) (*BasicAllocator, error) {
 
 // Allocate find the address in pool.addresses but not in pool.allocations
 func (a *BasicAllocator) Allocate(pool pool.Pool, info *ippoolv1alpha1.IPAllocation) (pool.Address, error) {
-	ipAddrLst, err := pool.GetAddresses()
-	if err != nil {
-		return nil, err
-	}
-	a.logger.Println("Loop to find allocable address")
-	for _, ipAddr := range ipAddrLst {
-		if !ipAddr.Allocated() {
-			a.logger.Println("Found allocable address", ipAddr)
-			if err := pool.MarkAddressAllocated(ipAddr, info); err != nil {
-				return nil, err
-			}
-			return ipAddr, nil
+	return allocateWith(a.logger, pool, info, pickFirst)
+}
+
+// pickFirst return the first free address
+func pickFirst(addrs []pool.Address) pool.Address {
+	for _, addr := range addrs {
+		if allocable(addr) {
+			return addr
 		}
 	}
-	err = fmt.Errorf("cannot allocate")
-	a.logger.Println(err)
-	return nil, err
+	return nil
 }
 
 // Release just call pool.MarkAddressReleased which delete specific address from pool.allocations
@@ -47,3 +41,5 @@ func (a *BasicAllocator) Release(pool pool.Pool, containerID string) error {
 	a.logger.Printf("Releasing address with target %s", containerID)
 	return pool.MarkAddressReleased(containerID)
 }
+
+var _ Allocator = &BasicAllocator{}
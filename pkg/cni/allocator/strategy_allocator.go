@@ -0,0 +1,102 @@
+package allocator
+
+import (
+	"math/rand"
+	"time"
+
+	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+	"github.com/jbliao/kubeipam/pkg/cni/pool"
+)
+
+// RandomAllocator allocate a free address at random
+type RandomAllocator struct {
+	*BasicAllocator
+}
+
+// Allocate impl Allocator.Allocate
+func (a *RandomAllocator) Allocate(p pool.Pool, info *ippoolv1alpha1.IPAllocation) (pool.Address, error) {
+	return allocateWith(a.logger, p, info, pickRandom)
+}
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// pickRandom return a free address at random
+func pickRandom(addrs []pool.Address) pool.Address {
+	free := []pool.Address{}
+	for _, addr := range addrs {
+		if allocable(addr) {
+			free = append(free, addr)
+		}
+	}
+	if len(free) == 0 {
+		return nil
+	}
+	return free[random.Intn(len(free))]
+}
+
+// RoundRobinAllocator allocate the next free address after the one allocated
+// last, so that addresses are reused as late as possible
+type RoundRobinAllocator struct {
+	*BasicAllocator
+}
+
+// Allocate impl Allocator.Allocate
+func (a *RoundRobinAllocator) Allocate(p pool.Pool, info *ippoolv1alpha1.IPAllocation) (pool.Address, error) {
+	last := ""
+	if cursor, ok := p.(pool.CursorPool); ok {
+		last = cursor.LastAllocated()
+	}
+	return allocateWith(a.logger, p, info, func(addrs []pool.Address) pool.Address {
+		return pickNext(addrs, last)
+	})
+}
+
+// pickNext return the first free address after last. If last is not given
+// or gone, it goes on from the latest allocation still in place.
+func pickNext(addrs []pool.Address, last string) pool.Address {
+	start := -1
+	var lastAt time.Time
+	for idx, addr := range addrs {
+		if last != "" && addr.String() == last {
+			start = idx
+			break
+		}
+		if at := addr.AllocatedAt(); addr.Allocated() && at.After(lastAt) {
+			start, lastAt = idx, at
+		}
+	}
+	for offset := 1; offset <= len(addrs); offset++ {
+		if addr := addrs[(start+offset)%len(addrs)]; allocable(addr) {
+			return addr
+		}
+	}
+	return nil
+}
+
+// LRUAllocator allocate the free address released longest ago, and the never
+// released ones first
+type LRUAllocator struct {
+	*BasicAllocator
+}
+
+// Allocate impl Allocator.Allocate
+func (a *LRUAllocator) Allocate(p pool.Pool, info *ippoolv1alpha1.IPAllocation) (pool.Address, error) {
+	return allocateWith(a.logger, p, info, pickLeastRecentlyReleased)
+}
+
+// pickLeastRecentlyReleased return the free address released longest ago
+func pickLeastRecentlyReleased(addrs []pool.Address) (picked pool.Address) {
+	for _, addr := range addrs {
+		if !allocable(addr) {
+			continue
+		}
+		if picked == nil || addr.ReleasedAt().Before(picked.ReleasedAt()) {
+			picked = addr
+		}
+	}
+	return
+}
+
+var _ Allocator = &RandomAllocator{}
+var _ Allocator = &RoundRobinAllocator{}
+var _ Allocator = &LRUAllocator{}
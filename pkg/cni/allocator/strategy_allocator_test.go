@@ -0,0 +1,139 @@
+package allocator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+// newStrategyPool return a pool of 10.0.0.1-4, with .2 allocated last and .1
+// allocated before it, .3 released just now and .4 released long ago
+func newStrategyPool() *fakePool {
+	now := time.Now()
+	return &fakePool{
+		addrs: []*fakeAddress{
+			{IP: net.ParseIP("10.0.0.1"), allocated: true, allocatedAt: now.Add(-time.Hour)},
+			{IP: net.ParseIP("10.0.0.2"), allocated: true, allocatedAt: now.Add(-time.Minute)},
+			{IP: net.ParseIP("10.0.0.3"), releasedAt: now},
+			{IP: net.ParseIP("10.0.0.4"), releasedAt: now.Add(-time.Hour)},
+		},
+		pending: map[string]time.Time{},
+	}
+}
+
+func TestNewAllocator(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	for strategy, expect := range map[ippoolv1alpha1.AllocationStrategy]Allocator{
+		"":                                  &BasicAllocator{},
+		ippoolv1alpha1.AllocationFirst:      &BasicAllocator{},
+		ippoolv1alpha1.AllocationRandom:     &RandomAllocator{},
+		ippoolv1alpha1.AllocationRoundRobin: &RoundRobinAllocator{},
+		ippoolv1alpha1.AllocationLeastRecentlyReleased: &LRUAllocator{},
+	} {
+		alctr, err := New(strategy, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fmt.Sprintf("%T", alctr), fmt.Sprintf("%T", expect); got != want {
+			t.Errorf("strategy %q: expect %s, got %s", strategy, want, got)
+		}
+	}
+	if _, err := New("Unknown", logger); err == nil {
+		t.Errorf("unknown strategy should fail")
+	}
+}
+
+func TestStrategyAllocators(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	info := &ippoolv1alpha1.IPAllocation{ContainerID: "c"}
+	for strategy, expect := range map[ippoolv1alpha1.AllocationStrategy]string{
+		ippoolv1alpha1.AllocationFirst:                 "10.0.0.3",
+		ippoolv1alpha1.AllocationRoundRobin:            "10.0.0.3",
+		ippoolv1alpha1.AllocationLeastRecentlyReleased: "10.0.0.4",
+	} {
+		alctr, _ := New(strategy, logger)
+		addr, err := alctr.Allocate(newStrategyPool(), info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != expect {
+			t.Errorf("strategy %s: expect %s, got %s", strategy, expect, addr)
+		}
+	}
+
+	// round robin wraps around to the start
+	p := newStrategyPool()
+	p.addrs[0].allocated = false
+	p.addrs[2].allocated = true
+	p.addrs[3].allocated = true
+	p.addrs[3].allocatedAt = time.Now()
+	alctr, _ := New(ippoolv1alpha1.AllocationRoundRobin, logger)
+	if addr, _ := alctr.Allocate(p, info); addr == nil || addr.String() != "10.0.0.1" {
+		t.Errorf("round robin should wrap around to 10.0.0.1, got %v", addr)
+	}
+
+	// round robin does not hand a released address out again at once
+	p = &fakePool{addrs: []*fakeAddress{
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("10.0.0.2")},
+		{IP: net.ParseIP("10.0.0.3")},
+	}}
+	first, err := alctr.Allocate(p, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.(*fakeAddress).allocated = false
+	second, err := alctr.Allocate(p, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != "10.0.0.1" || second.String() != "10.0.0.2" {
+		t.Errorf("round robin should go on after the released %s, got %s", first, second)
+	}
+
+	// random only choose free addresses, and all of them in time
+	alctr, _ = New(ippoolv1alpha1.AllocationRandom, logger)
+	seen := map[string]bool{}
+	for idx := 0; idx < 100; idx++ {
+		addr, err := alctr.Allocate(newStrategyPool(), info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[addr.String()] = true
+	}
+	if len(seen) != 2 || !seen["10.0.0.3"] || !seen["10.0.0.4"] {
+		t.Errorf("random should choose among free addresses, got %v", seen)
+	}
+
+	// every strategy skips the addresses in cooldown
+	for _, strategy := range []ippoolv1alpha1.AllocationStrategy{
+		ippoolv1alpha1.AllocationFirst, ippoolv1alpha1.AllocationRandom,
+		ippoolv1alpha1.AllocationRoundRobin, ippoolv1alpha1.AllocationLeastRecentlyReleased,
+	} {
+		p := newStrategyPool()
+		p.addrs[2].cooling = true
+		p.addrs[3].cooling = true
+		alctr, _ := New(strategy, logger)
+		if addr, err := alctr.Allocate(p, info); err != ErrPoolExhausted {
+			t.Errorf("strategy %s: expect cooling addresses skipped, got %v %v", strategy, addr, err)
+		}
+	}
+
+	// every strategy fails on an exhausted pool
+	for _, strategy := range []ippoolv1alpha1.AllocationStrategy{
+		ippoolv1alpha1.AllocationFirst, ippoolv1alpha1.AllocationRandom,
+		ippoolv1alpha1.AllocationRoundRobin, ippoolv1alpha1.AllocationLeastRecentlyReleased,
+	} {
+		p := newStrategyPool()
+		p.addrs = p.addrs[:2]
+		alctr, _ := New(strategy, logger)
+		if _, err := alctr.Allocate(p, info); err != ErrPoolExhausted {
+			t.Errorf("strategy %s: expect exhausted, got %v", strategy, err)
+		}
+	}
+}
@@ -1,23 +1,191 @@
 package cni
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
 	"github.com/containernetworking/cni/pkg/types"
 )
 
 // IPAMConf extend official's IPAM config
 type IPAMConf struct {
 	types.IPAM
-	KubeConfigPath string   `json:"configPath"`
-	PoolName       string   `json:"poolName"`
-	PoolNamespace  string   `json:"poolNamespace"`
-	Mask           string   `json:"mask"`
-	Gateway        string   `json:"gateway"`
-	Routes         []string `json:"routes"`
-	LogFile        string   `json:"logFile"`
+	KubeConfigPath string `json:"configPath"`
+	PoolName       string `json:"poolName"`
+	PoolNamespace  string `json:"poolNamespace"`
+	LogFile        string `json:"logFile"`
+
+	// Pools is the pools to allocate from in priority order, as "name" in
+	// PoolNamespace or "namespace/name". It replaces PoolName if given.
+	Pools []string `json:"pools"`
+
+	// Mask, Gateway and Routes, if set, override the network of the pool,
+	// see IPPoolSpec.Network. Mask is in the form of an address of the
+	// family of pool, e.g. "255.255.255.0" or "ffff:ffff:ffff:ffff::".
+	Mask    string      `json:"mask"`
+	Gateway string      `json:"gateway"`
+	Routes  []RouteConf `json:"routes"`
+
+	// DisableDefaultRoute leave out the default route via Gateway, e.g. for
+	// secondary interfaces. There is no default route without Gateway.
+	DisableDefaultRoute bool `json:"disableDefaultRoute"`
+
+	// DNS, if set, override the dns of the pool field by field
+	DNS *types.DNS `json:"dns"`
+
+	// WaitTimeout is how long to wait for an exhausted pool to grow, in
+	// time.ParseDuration format, e.g. "20s". Allocation fails at once if empty.
+	WaitTimeout string `json:"waitTimeout"`
+
+	// AllocationStrategy override the allocation strategy of pool, see
+	// IPPoolSpec.AllocationStrategy
+	AllocationStrategy string `json:"allocationStrategy"`
+
+	// DataDir is the directory on node where the pool of each container is
+	// recorded at ADD for DEL, default to /var/lib/cni/kubeipam
+	DataDir string `json:"dataDir"`
+}
+
+const (
+	// RequestedIPAnnotation is the annotation of pod asking for a specific address
+	RequestedIPAnnotation = "ipam.k8s.cc.cs.nctu.edu.tw/ip"
+	// PoolAnnotation is the annotation of pod or namespace selecting the pool
+	// to allocate from, as "name" in the same namespace or "namespace/name".
+	// The pod annotation wins over the namespace one, which wins over the
+	// pool of IPAMConf.
+	PoolAnnotation = "ipam.k8s.cc.cs.nctu.edu.tw/pool"
+	// NodeNameEnv is the environment variable giving the node cccni runs on
+	NodeNameEnv = "NODE_NAME"
+)
+
+// K8sArgs is the CNI_ARGS of a pod. Unlike the K8sArgs of multus, IP is kept
+// as given and parsed by ParseRequestedIP, so it may be in cidr format.
+type K8sArgs struct {
+	types.CommonArgs
+	IP                         types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+}
+
+// LoadK8sArgs load the K8sArgs of args, ignoring the unknown ones
+func LoadK8sArgs(args string) (*K8sArgs, error) {
+	k8sArgs := &K8sArgs{}
+	k8sArgs.IgnoreUnknown = true
+	if err := types.LoadArgs(args, k8sArgs); err != nil {
+		return nil, fmt.Errorf("cannot load CNI_ARGS: %v", err)
+	}
+	return k8sArgs, nil
+}
+
+// NodeArgs is the CNI_ARGS giving the node cccni runs on
+type NodeArgs struct {
+	types.CommonArgs
+	K8S_NODE_NAME types.UnmarshallableString
+}
+
+// NodeName return the node cccni runs on, from K8S_NODE_NAME of args, or else
+// NodeNameEnv, or else the hostname
+func NodeName(args string) (string, error) {
+	nodeArgs := &NodeArgs{}
+	nodeArgs.IgnoreUnknown = true
+	if err := types.LoadArgs(args, nodeArgs); err != nil {
+		return "", err
+	}
+	if name := string(nodeArgs.K8S_NODE_NAME); name != "" {
+		return name, nil
+	}
+	if name := os.Getenv(NodeNameEnv); name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
+
+// RouteConf is a route of IPAMConf. It is given as an object, or as the
+// destination cidr alone, which goes via the gateway.
+type RouteConf struct {
+	Dst    string `json:"dst"`
+	GW     string `json:"gw,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+}
+
+// UnmarshalJSON ...
+func (r *RouteConf) UnmarshalJSON(data []byte) error {
+	var dst string
+	if err := json.Unmarshal(data, &dst); err == nil {
+		*r = RouteConf{Dst: dst}
+		return nil
+	}
+	type plain RouteConf
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// RuntimeConfig is the runtime config passed by container runtime
+type RuntimeConfig struct {
+	// IPs is the addresses asked for with the "ips" capability
+	IPs []string `json:"ips,omitempty"`
 }
 
 // PluginConf extend official's cni conf, but use custom ipamconf
 type PluginConf struct {
 	types.NetConf
-	IPAM IPAMConf `json:"ipam"`
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig,omitempty"`
+	IPAM          IPAMConf      `json:"ipam"`
+}
+
+// ParseRequestedIP parse an address asked for, given alone or in cidr format
+func ParseRequestedIP(raw string) (net.IP, error) {
+	if ip, _, err := net.ParseCIDR(raw); err == nil {
+		return ip, nil
+	}
+	if ip := net.ParseIP(raw); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("cannot parse requested address %q", raw)
+}
+
+// PoolRef identify an IPPool
+type PoolRef struct {
+	Namespace string
+	Name      string
+}
+
+func (r PoolRef) String() string {
+	return r.Namespace + "/" + r.Name
+}
+
+// ParsePoolRef parse a pool given as "name" or "namespace/name", a bare name
+// is taken to be in namespace
+func ParsePoolRef(raw, namespace string) (PoolRef, error) {
+	parts := strings.Split(strings.TrimSpace(raw), "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return PoolRef{Namespace: namespace, Name: parts[0]}, nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return PoolRef{Namespace: parts[0], Name: parts[1]}, nil
+	}
+	return PoolRef{}, fmt.Errorf("cannot parse pool %q", raw)
+}
+
+// PoolRefs return the pools of config in priority order, Pools if given, or
+// else PoolName
+func (c *IPAMConf) PoolRefs() ([]PoolRef, error) {
+	if len(c.Pools) == 0 {
+		if c.PoolName == "" {
+			return nil, nil
+		}
+		return []PoolRef{{Namespace: c.PoolNamespace, Name: c.PoolName}}, nil
+	}
+	refs := []PoolRef{}
+	for _, raw := range c.Pools {
+		ref, err := ParsePoolRef(raw, c.PoolNamespace)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
 }
@@ -0,0 +1,55 @@
+package cni
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestPoolRefs(t *testing.T) {
+	conf := &IPAMConf{PoolName: "a", PoolNamespace: "ns"}
+	refs, err := conf.PoolRefs()
+	if err != nil || !reflect.DeepEqual(refs, []PoolRef{{"ns", "a"}}) {
+		t.Errorf("expect ns/a, got %v %v", refs, err)
+	}
+
+	conf.Pools = []string{"b", "other/c"}
+	refs, err = conf.PoolRefs()
+	if err != nil || !reflect.DeepEqual(refs, []PoolRef{{"ns", "b"}, {"other", "c"}}) {
+		t.Errorf("expect ns/b and other/c, got %v %v", refs, err)
+	}
+
+	conf.Pools = []string{"a/b/c"}
+	if _, err = conf.PoolRefs(); err == nil {
+		t.Errorf("expect a/b/c refused")
+	}
+}
+
+func TestNodeName(t *testing.T) {
+	os.Setenv(NodeNameEnv, "env-node")
+	defer os.Unsetenv(NodeNameEnv)
+
+	if name, err := NodeName("IgnoreUnknown=1;K8S_POD_NAME=a;K8S_NODE_NAME=arg-node"); err != nil || name != "arg-node" {
+		t.Errorf("expect arg-node, got %s %v", name, err)
+	}
+	if name, err := NodeName("K8S_POD_NAME=a"); err != nil || name != "env-node" {
+		t.Errorf("expect env-node, got %s %v", name, err)
+	}
+}
+
+func TestLoadK8sArgs(t *testing.T) {
+	k8sArgs, err := LoadK8sArgs("IP=10.0.0.5/24;K8S_POD_NAME=web-0;K8S_POD_NAMESPACE=prod;FOO=bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k8sArgs.K8S_POD_NAME != "web-0" || k8sArgs.K8S_POD_NAMESPACE != "prod" {
+		t.Errorf("pod not loaded: %+v", k8sArgs)
+	}
+	if ip, err := ParseRequestedIP(string(k8sArgs.IP)); err != nil || !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("expect 10.0.0.5, got %v %v", ip, err)
+	}
+	if _, err := ParseRequestedIP("10.0.0"); err == nil {
+		t.Errorf("expect invalid address refused")
+	}
+}
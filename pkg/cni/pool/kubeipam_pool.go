@@ -5,17 +5,27 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"time"
 
 	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
 	"github.com/jbliao/kubeipam/pkg/cni"
 	"github.com/jbliao/kubeipam/pkg/crd/clientset"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 )
 
 // KubeIpamAddress impl Address interface
 type KubeIpamAddress struct {
 	net.IP
-	allocated bool
+	allocated   bool
+	allocatedAt time.Time
+	releasedAt  time.Time
+	cooling     bool
+	reserved    bool
 }
 
 // Allocated ...
@@ -28,6 +38,26 @@ func (a *KubeIpamAddress) NetIP() net.IP {
 	return a.IP
 }
 
+// AllocatedAt impl Address.AllocatedAt
+func (a *KubeIpamAddress) AllocatedAt() time.Time {
+	return a.allocatedAt
+}
+
+// Cooling impl Address.Cooling
+func (a *KubeIpamAddress) Cooling() bool {
+	return a.cooling
+}
+
+// Reserved impl Address.Reserved
+func (a *KubeIpamAddress) Reserved() bool {
+	return a.reserved
+}
+
+// ReleasedAt impl Address.ReleasedAt
+func (a *KubeIpamAddress) ReleasedAt() time.Time {
+	return a.releasedAt
+}
+
 var _ Address = &KubeIpamAddress{}
 
 // KubeIPAMPool implement Pool interface
@@ -36,6 +66,17 @@ type KubeIPAMPool struct {
 	config *cni.IPAMConf
 	logger *log.Logger
 	cache  *ippoolv1alpha1.IPPool
+
+	// ref is the pool in use, selected is the one chosen by SelectForPod,
+	// and pod the pod it fetched, nil if missing
+	ref      cni.PoolRef
+	selected *cni.PoolRef
+	pod      *corev1.Pod
+
+	// node is the node cccni runs on and nodeLabels its labels, fetched on
+	// demand, see SetNode
+	node       string
+	nodeLabels labels.Set
 }
 
 // NewKubeIPAMPool construct a KubeIPAMPool object
@@ -51,7 +92,7 @@ func NewKubeIPAMPool(ipamConf *cni.IPAMConf, logger *log.Logger) (*KubeIPAMPool,
 	}
 	client, err := clientset.NewForConfig(config, logger)
 
-	if ipamConf.PoolNamespace == "" {
+	if (ipamConf.PoolName != "" || len(ipamConf.Pools) > 0) && ipamConf.PoolNamespace == "" {
 		//decide namespace from Kubectl Context if not given
 		logger.Printf("PoolNamespace is empty, decide from context")
 		var namespace string
@@ -72,13 +113,157 @@ func NewKubeIPAMPool(ipamConf *cni.IPAMConf, logger *log.Logger) (*KubeIPAMPool,
 		client: client,
 		config: ipamConf,
 		logger: logger,
+		ref:    cni.PoolRef{Namespace: ipamConf.PoolNamespace, Name: ipamConf.PoolName},
 	}, nil
 }
 
+// Use switch to the pool ref
+func (p *KubeIPAMPool) Use(ref cni.PoolRef) {
+	p.ref = ref
+	p.Refresh()
+}
+
+// Ref return the pool in use
+func (p *KubeIPAMPool) Ref() cni.PoolRef {
+	return p.ref
+}
+
+// SetNode set the node cccni runs on, whose labels are matched against the
+// NodeSelector of candidate pools. The node is only fetched once a candidate
+// pool has a NodeSelector.
+func (p *KubeIPAMPool) SetNode(name string) {
+	p.node = name
+}
+
+// getNodeLabels return the labels of the node of SetNode, fetched once
+func (p *KubeIPAMPool) getNodeLabels() (labels.Set, error) {
+	if p.nodeLabels != nil {
+		return p.nodeLabels, nil
+	}
+	if p.node == "" {
+		err := fmt.Errorf("node unknown to match NodeSelector of pool")
+		p.logger.Println(err)
+		return nil, err
+	}
+	node, err := p.client.GetNode(p.node)
+	if err != nil {
+		return nil, err
+	}
+	p.nodeLabels = labels.Merge(labels.Set{}, node.Labels)
+	return p.nodeLabels, nil
+}
+
+// Candidates return the pools to allocate from in priority order, which is
+// the pool selected by SelectForPod if any, or else the pools of config.
+// Pools whose NodeSelector does not match the node of SetNode are left out,
+// missing pools are kept for the caller to skip.
+func (p *KubeIPAMPool) Candidates() ([]cni.PoolRef, error) {
+	refs := []cni.PoolRef{}
+	if p.selected != nil {
+		refs = append(refs, *p.selected)
+	} else {
+		var err error
+		if refs, err = p.config.PoolRefs(); err != nil {
+			return nil, err
+		}
+	}
+
+	matched := []cni.PoolRef{}
+	for _, ref := range refs {
+		pool, err := p.client.GetIPPool(ref.Namespace, ref.Name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil && len(pool.Spec.NodeSelector) > 0 {
+			nodeLabels, err := p.getNodeLabels()
+			if err != nil {
+				return nil, err
+			}
+			if !labels.SelectorFromSet(pool.Spec.NodeSelector).Matches(nodeLabels) {
+				p.logger.Printf("Pool %s not for node %s", ref, p.node)
+				continue
+			}
+		}
+		matched = append(matched, ref)
+	}
+	if len(refs) > 0 && len(matched) == 0 {
+		err := fmt.Errorf("no pool of %v is for node %s", refs, p.node)
+		p.logger.Println(err)
+		return nil, err
+	}
+	return matched, nil
+}
+
+// UseHolder switch to the pool holding the allocation of containerID, looked
+// for in the pool recorded for it at ADD, the pool selected by SelectForPod
+// and the pools of config, or else in every pool as a last resort. Missing
+// pools are skipped. false is returned if none holds it.
+func (p *KubeIPAMPool) UseHolder(containerID string) (bool, error) {
+	refs, err := p.config.PoolRefs()
+	if err != nil {
+		return false, err
+	}
+	if p.selected != nil {
+		refs = append([]cni.PoolRef{*p.selected}, refs...)
+	}
+	if recorded, err := p.config.RecordedPool(containerID); err != nil {
+		// the record is only a hint, the other pools are looked in anyway
+		p.logger.Println(err)
+	} else if recorded != nil {
+		refs = append([]cni.PoolRef{*recorded}, refs...)
+	}
+	tried := map[cni.PoolRef]bool{}
+	for _, ref := range refs {
+		if tried[ref] {
+			continue
+		}
+		tried[ref] = true
+		p.Use(ref)
+		if err := p.ensureCache(); apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		for _, alc := range p.cache.Spec.Allocations {
+			if alc.ContainerID == containerID {
+				p.logger.Printf("Container %s found in pool %s", containerID, ref)
+				return true, nil
+			}
+		}
+	}
+	return p.useAnyHolder(containerID)
+}
+
+// useAnyHolder switch to the pool holding the allocation of containerID
+// among all pools
+func (p *KubeIPAMPool) useAnyHolder(containerID string) (bool, error) {
+	pools, err := p.client.ListIPPools()
+	if err != nil {
+		return false, err
+	}
+	for _, pool := range pools {
+		for _, alc := range pool.Spec.Allocations {
+			if alc.ContainerID != containerID {
+				continue
+			}
+			ref := cni.PoolRef{Namespace: pool.Namespace, Name: pool.Name}
+			p.logger.Printf("Container %s found in pool %s out of candidates", containerID, ref)
+			p.Use(ref)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (p *KubeIPAMPool) ensureCache() error {
 	var err error = nil
+	if p.ref.Name == "" {
+		err = fmt.Errorf("no pool selected by pod, namespace or cni config")
+		p.logger.Println(err)
+		return err
+	}
 	if p.cache == nil {
-		p.cache, err = p.client.GetIPPool(p.config.PoolNamespace, p.config.PoolName)
+		p.cache, err = p.client.GetIPPool(p.ref.Namespace, p.ref.Name)
 	}
 	return err
 }
@@ -98,16 +283,23 @@ func (p *KubeIPAMPool) GetAddresses() (ret []Address, err error) {
 		return
 	}
 
-	alctionSet := map[string]interface{}{}
+	alctionSet := map[string]ippoolv1alpha1.IPAllocation{}
 	for _, alc := range p.cache.Spec.Allocations {
 		alctionSet[alc.Address] = alc
 	}
 
+	now := time.Now()
 	for _, addr := range p.cache.Spec.Addresses {
-		_, allocated := alctionSet[addr]
+		alc, allocated := alctionSet[addr]
 		ipa := &KubeIpamAddress{
-			IP:        net.ParseIP(addr),
-			allocated: allocated,
+			IP:         net.ParseIP(addr),
+			allocated:  allocated,
+			releasedAt: p.cache.Spec.Releases[addr].Time,
+			cooling:    !allocated && p.cache.Spec.IsCooling(addr, now),
+			reserved:   !allocated && p.cache.Spec.IsReserved(addr),
+		}
+		if allocated && alc.AllocatedAt != nil {
+			ipa.allocatedAt = alc.AllocatedAt.Time
 		}
 		ret = append(ret, ipa)
 	}
@@ -123,14 +315,32 @@ func (p *KubeIPAMPool) MarkAddressAllocated(addr Address, info *ippoolv1alpha1.I
 		p.logger.Println(err)
 		return err
 	}
+	if rsv := p.cache.Spec.ReservationOf(info.PodNamespace, info.PodName); addr.Reserved() &&
+		(rsv == nil || rsv.Address != addr.String()) {
+		err := fmt.Errorf("address reserved for another pod")
+		p.logger.Println(err)
+		return err
+	}
+	p.cache.Spec.Unreserve(info.PodNamespace, info.PodName)
 	newObj := info.DeepCopy()
 	newObj.Address = addr.String()
+	now := metav1.Now()
+	newObj.AllocatedAt = &now
+	newObj.Pool = p.ref.String()
 	p.cache.Spec.Allocations = append(p.cache.Spec.Allocations, *newObj)
+	p.cache.Spec.LastAllocated = newObj.Address
 	return p.updateWithCache()
 }
 
 func (p *KubeIPAMPool) deleteAllocationWithIndex(idx int) error {
-	p.logger.Printf("Found allocation to release: %v", p.cache.Spec.Allocations[idx])
+	alc := p.cache.Spec.Allocations[idx]
+	p.logger.Printf("Found allocation to release: %v", alc)
+	if p.cache.Spec.Sticky {
+		p.logger.Printf("Keep %s for %s/%s", alc.Address, alc.PodNamespace, alc.PodName)
+		p.cache.Spec.Reserve(alc.Address, alc.PodNamespace, alc.PodName)
+	} else {
+		p.cache.Spec.RecordRelease(alc.Address, time.Now())
+	}
 	p.cache.Spec.Allocations = append(
 		p.cache.Spec.Allocations[:idx],
 		p.cache.Spec.Allocations[idx+1:]...,
@@ -138,6 +348,109 @@ func (p *KubeIPAMPool) deleteAllocationWithIndex(idx int) error {
 	return p.updateWithCache()
 }
 
+// ReservedAddress impl StickyPool.ReservedAddress
+func (p *KubeIPAMPool) ReservedAddress(info *ippoolv1alpha1.IPAllocation) (Address, error) {
+	if err := p.ensureCache(); err != nil {
+		return nil, err
+	}
+	rsv := p.cache.Spec.ReservationOf(info.PodNamespace, info.PodName)
+	if rsv == nil {
+		return nil, nil
+	}
+	addrs, err := p.GetAddresses()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.String() == rsv.Address && !addr.Allocated() {
+			return addr, nil
+		}
+	}
+	// the address left the pool or is taken, the pod gets a new one
+	p.logger.Printf("Reserved address %s not available", rsv.Address)
+	return nil, nil
+}
+
+// PodAnnotations return the annotations of the pod fetched by SelectForPod,
+// nil if it is missing
+func (p *KubeIPAMPool) PodAnnotations() map[string]string {
+	if p.pod == nil {
+		return nil
+	}
+	return p.pod.Annotations
+}
+
+// SelectForPod switch to the pool selected by PoolAnnotation of the pod with
+// namespace and name, or else of its namespace, which then replaces the pools
+// of config as the only candidate. The pools of config are kept if neither is
+// annotated. A pod may only select a pool of its own namespace, while its
+// namespace, annotated by admins, may select any pool. A missing pod, e.g. on
+// DEL, is not an error. The selection is left unchanged on error.
+func (p *KubeIPAMPool) SelectForPod(namespace, name string) error {
+	if namespace == "" {
+		return nil
+	}
+	pod, err := p.client.GetPod(namespace, name)
+	switch {
+	case err == nil:
+		p.pod = pod
+	case !apierrors.IsNotFound(err):
+		return err
+	}
+
+	raw, ok := p.PodAnnotations()[cni.PoolAnnotation]
+	byPod := ok
+	if !ok {
+		ns, err := p.client.GetNamespace(namespace)
+		if err != nil {
+			return err
+		}
+		raw, ok = ns.Annotations[cni.PoolAnnotation]
+	}
+	if !ok {
+		return nil
+	}
+
+	ref, err := cni.ParsePoolRef(raw, namespace)
+	if err != nil {
+		p.logger.Println(err)
+		return err
+	}
+	if byPod && ref.Namespace != namespace {
+		err = fmt.Errorf("pod %s/%s cannot select pool %s out of its namespace", namespace, name, ref)
+		p.logger.Println(err)
+		return err
+	}
+	p.logger.Printf("Pool %s selected for %s/%s", ref, namespace, name)
+	p.selected = &ref
+	p.Use(ref)
+	return nil
+}
+
+// Network return the network parameters of pool, nil if not given
+func (p *KubeIPAMPool) Network() (*ippoolv1alpha1.IPPoolNetwork, error) {
+	if err := p.ensureCache(); err != nil {
+		return nil, err
+	}
+	return p.cache.Spec.Network, nil
+}
+
+// LastAllocated impl CursorPool.LastAllocated
+func (p *KubeIPAMPool) LastAllocated() string {
+	if err := p.ensureCache(); err != nil {
+		return ""
+	}
+	return p.cache.Spec.LastAllocated
+}
+
+// AllocationStrategy return the allocation strategy of pool
+func (p *KubeIPAMPool) AllocationStrategy() (ippoolv1alpha1.AllocationStrategy, error) {
+	if err := p.ensureCache(); err != nil {
+		return "", err
+	}
+	return p.cache.Spec.AllocationStrategy, nil
+}
+
 // MarkAddressReleased remove an allocation indicated by ip, and call updateWithCache()
 func (p *KubeIPAMPool) MarkAddressReleased(containerID string) error {
 	if err := p.ensureCache(); err != nil {
@@ -153,4 +466,24 @@ func (p *KubeIPAMPool) MarkAddressReleased(containerID string) error {
 	return nil
 }
 
-var _ Pool = &KubeIPAMPool{}
+// Refresh impl GrowablePool.Refresh
+func (p *KubeIPAMPool) Refresh() {
+	p.cache = nil
+}
+
+// SignalDemand impl GrowablePool.SignalDemand with the pending claims
+// annotation of pool, which wakes the controller up
+func (p *KubeIPAMPool) SignalDemand(containerID string, until time.Time) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		p.Refresh()
+		if err := p.ensureCache(); err != nil {
+			return err
+		}
+		p.cache.SetPendingClaim(containerID, until, time.Now())
+		return p.updateWithCache()
+	})
+}
+
+var _ GrowablePool = &KubeIPAMPool{}
+var _ StickyPool = &KubeIPAMPool{}
+var _ CursorPool = &KubeIPAMPool{}
@@ -0,0 +1,189 @@
+package pool
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+	"github.com/jbliao/kubeipam/pkg/cni"
+	"github.com/jbliao/kubeipam/pkg/crd/clientset"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestPool(conf *cni.IPAMConf, objs ...runtime.Object) *KubeIPAMPool {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = ippoolv1alpha1.AddToScheme(scheme)
+	logger := log.New(ioutil.Discard, "", 0)
+	return &KubeIPAMPool{
+		client: clientset.NewForClient(fake.NewFakeClientWithScheme(scheme, objs...), logger),
+		config: conf,
+		logger: logger,
+		ref:    cni.PoolRef{Namespace: conf.PoolNamespace, Name: conf.PoolName},
+	}
+}
+
+func annotated(obj metav1.Object, pool string) {
+	obj.SetAnnotations(map[string]string{cni.PoolAnnotation: pool})
+}
+
+func TestSelectForPod(t *testing.T) {
+	team := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team"}}
+	annotated(team, "kube-system/team-pool")
+	plain := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "plain"}}
+	podPool := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "a"}}
+	annotated(podPool, "team/pod-pool")
+	nsPool := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "b"}}
+	confPool := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "plain", Name: "c"}}
+	objs := []runtime.Object{team, plain, podPool, nsPool, confPool}
+
+	tests := []struct {
+		namespace, name string
+		expect          []cni.PoolRef
+	}{
+		// the pod annotation wins over the namespace one
+		{"team", "a", []cni.PoolRef{{Namespace: "team", Name: "pod-pool"}}},
+		// the namespace annotation wins over the config, and may select a
+		// pool of another namespace
+		{"team", "b", []cni.PoolRef{{Namespace: "kube-system", Name: "team-pool"}}},
+		// a missing pod falls back to its namespace
+		{"team", "gone", []cni.PoolRef{{Namespace: "kube-system", Name: "team-pool"}}},
+		// nothing annotated keeps the config
+		{"plain", "c", []cni.PoolRef{{Namespace: "kube-system", Name: "default"}}},
+	}
+	for _, test := range tests {
+		p := newTestPool(&cni.IPAMConf{PoolName: "default", PoolNamespace: "kube-system"}, objs...)
+		if err := p.SelectForPod(test.namespace, test.name); err != nil {
+			t.Errorf("%s/%s: %v", test.namespace, test.name, err)
+			continue
+		}
+		refs, err := p.Candidates()
+		if err != nil || !reflect.DeepEqual(refs, test.expect) {
+			t.Errorf("%s/%s: expect %v, got %v %v", test.namespace, test.name, test.expect, refs, err)
+		}
+	}
+
+	// the pod fetched is kept for its annotations
+	p := newTestPool(&cni.IPAMConf{PoolName: "default", PoolNamespace: "kube-system"}, objs...)
+	if err := p.SelectForPod("team", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if p.PodAnnotations()[cni.PoolAnnotation] != "team/pod-pool" {
+		t.Errorf("expect annotations of pod, got %v", p.PodAnnotations())
+	}
+}
+
+func TestSelectForPodOtherNamespace(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "a"}}
+	annotated(pod, "other/pod-pool")
+	p := newTestPool(&cni.IPAMConf{PoolName: "default", PoolNamespace: "kube-system"}, pod)
+	if err := p.SelectForPod("team", "a"); err == nil {
+		t.Fatal("expect a pod to be refused the pool of another namespace")
+	}
+	refs, err := p.Candidates()
+	if err != nil || !reflect.DeepEqual(refs, []cni.PoolRef{{Namespace: "kube-system", Name: "default"}}) {
+		t.Errorf("expect config kept on error, got %v %v", refs, err)
+	}
+}
+
+func TestSelectForPodError(t *testing.T) {
+	// the namespace is missing, so the lookup fails
+	p := newTestPool(&cni.IPAMConf{PoolName: "default", PoolNamespace: "kube-system"})
+	if err := p.SelectForPod("gone", "a"); err == nil {
+		t.Fatal("expect missing namespace to fail")
+	}
+	refs, err := p.Candidates()
+	if err != nil || !reflect.DeepEqual(refs, []cni.PoolRef{{Namespace: "kube-system", Name: "default"}}) {
+		t.Errorf("expect config kept on error, got %v %v", refs, err)
+	}
+}
+
+func TestUseHolder(t *testing.T) {
+	config := &ippoolv1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "default"},
+		Spec: ippoolv1alpha1.IPPoolSpec{Allocations: []ippoolv1alpha1.IPAllocation{
+			{Address: "10.0.0.1", ContainerID: "c1"}}},
+	}
+	// the pool is no longer selected by pod, namespace or config
+	moved := &ippoolv1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "moved"},
+		Spec: ippoolv1alpha1.IPPoolSpec{Allocations: []ippoolv1alpha1.IPAllocation{
+			{Address: "10.1.0.1", ContainerID: "c2", Pool: "other/moved"}}},
+	}
+	p := newTestPool(&cni.IPAMConf{PoolName: "default", PoolNamespace: "kube-system"}, config, moved)
+
+	if found, err := p.UseHolder("c1"); err != nil || !found || p.Ref() != (cni.PoolRef{Namespace: "kube-system", Name: "default"}) {
+		t.Errorf("expect c1 in kube-system/default, got %v %v %v", p.Ref(), found, err)
+	}
+	if found, err := p.UseHolder("c2"); err != nil || !found || p.Ref() != (cni.PoolRef{Namespace: "other", Name: "moved"}) {
+		t.Errorf("expect c2 in other/moved, got %v %v %v", p.Ref(), found, err)
+	}
+	if found, err := p.UseHolder("c3"); err != nil || found {
+		t.Errorf("expect c3 not found, got %v %v", found, err)
+	}
+}
+
+func TestUseHolderRecorded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeipam-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a stale allocation of c1 is left in the pool of config
+	config := &ippoolv1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "default"},
+		Spec: ippoolv1alpha1.IPPoolSpec{Allocations: []ippoolv1alpha1.IPAllocation{
+			{Address: "10.0.0.1", ContainerID: "c1"}}},
+	}
+	moved := &ippoolv1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "moved"},
+		Spec: ippoolv1alpha1.IPPoolSpec{Allocations: []ippoolv1alpha1.IPAllocation{
+			{Address: "10.1.0.1", ContainerID: "c1", Pool: "other/moved"}}},
+	}
+	conf := &cni.IPAMConf{PoolName: "default", PoolNamespace: "kube-system", DataDir: dir}
+	if err := conf.RecordPool("c1", cni.PoolRef{Namespace: "other", Name: "moved"}); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPool(conf, config, moved)
+	if found, err := p.UseHolder("c1"); err != nil || !found || p.Ref() != (cni.PoolRef{Namespace: "other", Name: "moved"}) {
+		t.Errorf("expect the recorded other/moved first, got %v %v %v", p.Ref(), found, err)
+	}
+}
+
+func TestCandidatesNodeSelector(t *testing.T) {
+	rack := &ippoolv1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "rack-a"},
+		Spec:       ippoolv1alpha1.IPPoolSpec{NodeSelector: map[string]string{"rack": "a"}},
+	}
+	shared := &ippoolv1alpha1.IPPool{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "any"}}
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{"rack": "b"}}}
+	conf := &cni.IPAMConf{PoolNamespace: "kube-system", Pools: []string{"rack-a", "any"}}
+
+	p := newTestPool(conf, rack, shared, node)
+	p.SetNode("n1")
+	refs, err := p.Candidates()
+	if err != nil || !reflect.DeepEqual(refs, []cni.PoolRef{{Namespace: "kube-system", Name: "any"}}) {
+		t.Errorf("expect kube-system/any, got %v %v", refs, err)
+	}
+
+	// the node is not needed without a NodeSelector, so its lookup cannot fail
+	p = newTestPool(&cni.IPAMConf{PoolNamespace: "kube-system", Pools: []string{"any"}}, shared)
+	p.SetNode("gone")
+	if refs, err := p.Candidates(); err != nil || len(refs) != 1 {
+		t.Errorf("expect kube-system/any, got %v %v", refs, err)
+	}
+
+	p = newTestPool(conf, rack, shared)
+	p.SetNode("gone")
+	if _, err := p.Candidates(); err == nil {
+		t.Errorf("expect missing node to fail a NodeSelector")
+	}
+}
@@ -2,6 +2,7 @@ package pool
 
 import (
 	"net"
+	"time"
 
 	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
 )
@@ -11,6 +12,14 @@ type Address interface {
 	Allocated() bool
 	String() string
 	NetIP() net.IP
+	// AllocatedAt is when the address was allocated, zero if free or unknown
+	AllocatedAt() time.Time
+	// ReleasedAt is when the address was released last, zero if never
+	ReleasedAt() time.Time
+	// Cooling report whether the address is free but still in cooldown
+	Cooling() bool
+	// Reserved report whether the address is free but kept for a pod
+	Reserved() bool
 }
 
 // Pool is used for allocator
@@ -19,3 +28,27 @@ type Pool interface {
 	MarkAddressAllocated(Address, *ippoolv1alpha1.IPAllocation) error
 	MarkAddressReleased(containerID string) error
 }
+
+// GrowablePool is a Pool which can ask its controller for more addresses
+type GrowablePool interface {
+	Pool
+	// SignalDemand tell that containerID waits for an address until the
+	// given time, or stops waiting if it is zero
+	SignalDemand(containerID string, until time.Time) error
+	// Refresh drop what the pool cached, to see the addresses added since
+	Refresh()
+}
+
+// StickyPool is a Pool which can keep the address of a pod across restarts
+type StickyPool interface {
+	Pool
+	// ReservedAddress return the address kept for the pod of info, or nil
+	ReservedAddress(info *ippoolv1alpha1.IPAllocation) (Address, error)
+}
+
+// CursorPool is a Pool which remembers the address allocated last
+type CursorPool interface {
+	Pool
+	// LastAllocated return the address allocated last, or "" if unknown
+	LastAllocated() string
+}
@@ -0,0 +1,68 @@
+package cni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultDataDir is the DataDir of configs which leave it unset
+const defaultDataDir = "/var/lib/cni/kubeipam"
+
+// recordPath return the path of the record of containerID
+func (c *IPAMConf) recordPath(containerID string) (string, error) {
+	if containerID == "" || strings.ContainsAny(containerID, `/\`) || containerID == "." || containerID == ".." {
+		return "", fmt.Errorf("invalid container id %q", containerID)
+	}
+	dir := c.DataDir
+	if dir == "" {
+		dir = defaultDataDir
+	}
+	return filepath.Join(dir, containerID), nil
+}
+
+// RecordPool record ref as the pool containerID is allocated from, so that
+// DEL finds it after the annotations or config changed
+func (c *IPAMConf) RecordPool(containerID string, ref PoolRef) error {
+	path, err := c.recordPath(containerID)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(ref.String()), 0644)
+}
+
+// RecordedPool return the pool recorded for containerID, nil if none
+func (c *IPAMConf) RecordedPool(containerID string) (*PoolRef, error) {
+	path, err := c.recordPath(containerID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ref, err := ParsePoolRef(string(data), "")
+	if err != nil || ref.Namespace == "" {
+		return nil, fmt.Errorf("invalid record %s of container %s", data, containerID)
+	}
+	return &ref, nil
+}
+
+// ForgetPool remove the record of containerID, if any
+func (c *IPAMConf) ForgetPool(containerID string) error {
+	path, err := c.recordPath(containerID)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
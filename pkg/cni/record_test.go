@@ -0,0 +1,41 @@
+package cni
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRecordPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeipam-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &IPAMConf{DataDir: dir + "/nested"}
+
+	if ref, err := conf.RecordedPool("c1"); err != nil || ref != nil {
+		t.Errorf("expect no record, got %v %v", ref, err)
+	}
+	if err := conf.RecordPool("c1", PoolRef{Namespace: "ns", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if ref, err := conf.RecordedPool("c1"); err != nil || ref == nil || *ref != (PoolRef{"ns", "a"}) {
+		t.Errorf("expect ns/a, got %v %v", ref, err)
+	}
+	if err := conf.ForgetPool("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if ref, err := conf.RecordedPool("c1"); err != nil || ref != nil {
+		t.Errorf("expect record forgotten, got %v %v", ref, err)
+	}
+	if err := conf.ForgetPool("c1"); err != nil {
+		t.Errorf("expect forgetting twice to be fine, got %v", err)
+	}
+
+	for _, id := range []string{"", "..", "../c1", "a/b"} {
+		if err := conf.RecordPool(id, PoolRef{Namespace: "ns", Name: "a"}); err == nil {
+			t.Errorf("expect container id %q refused", id)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+// defaultRoute return the destination of the default route of the family of
+// ip
+func defaultRoute(ip net.IP) net.IPNet {
+	if ip.To4() != nil {
+		return net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	}
+	return net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+}
+
+// sameFamily report whether a and b are both ipv4 or both ipv6
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
+// Result is current.Result with the metric of each route, which the route
+// type of the cni library in use cannot carry. Metrics are printed as the
+// "priority" of routes, the name cni spec 1.1 gives them.
+type Result struct {
+	*current.Result
+
+	// Metrics is the metric of each of Routes, 0 if unset
+	Metrics []int
+}
+
+// resultRoute is the json form of a route with its metric
+type resultRoute struct {
+	Dst      types.IPNet `json:"dst"`
+	GW       net.IP      `json:"gw,omitempty"`
+	Priority int         `json:"priority,omitempty"`
+}
+
+// GetAsVersion impl types.Result.GetAsVersion, the metrics are kept for
+// versions which have routes at top level
+func (r *Result) GetAsVersion(version string) (types.Result, error) {
+	converted, err := r.Result.GetAsVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if result, ok := converted.(*current.Result); ok {
+		return &Result{Result: result, Metrics: r.Metrics}, nil
+	}
+	return converted, nil
+}
+
+// Print impl types.Result.Print
+func (r *Result) Print() error {
+	return r.PrintTo(os.Stdout)
+}
+
+// PrintTo impl types.Result.PrintTo
+func (r *Result) PrintTo(writer io.Writer) error {
+	routes := []resultRoute{}
+	for i, route := range r.Routes {
+		routes = append(routes, resultRoute{Dst: types.IPNet(route.Dst), GW: route.GW})
+		if i < len(r.Metrics) {
+			routes[i].Priority = r.Metrics[i]
+		}
+	}
+	data, err := json.MarshalIndent(struct {
+		*current.Result
+		Routes []resultRoute `json:"routes,omitempty"`
+	}{r.Result, routes}, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+var _ types.Result = &Result{}
+
+// BuildResult build the cni result of ip from the network of its pool. The
+// Mask, Gateway, Routes and DNS of conf override those of network if set.
+func BuildResult(ip net.IP, network *ippoolv1alpha1.IPPoolNetwork, conf *IPAMConf) (*Result, error) {
+	if network == nil {
+		network = &ippoolv1alpha1.IPPoolNetwork{}
+	}
+
+	mask, err := resultMask(ip, network, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	gwRaw := network.Gateway
+	if conf.Gateway != "" {
+		gwRaw = conf.Gateway
+	}
+	var gw net.IP
+	if gwRaw != "" {
+		if gw = net.ParseIP(gwRaw); gw == nil {
+			return nil, fmt.Errorf("cannot parse gateway %q", gwRaw)
+		}
+		if !sameFamily(gw, ip) {
+			return nil, fmt.Errorf("gateway %s is not of the family of %s", gw, ip)
+		}
+	}
+
+	result := &Result{Result: &current.Result{
+		IPs: []*current.IPConfig{{
+			Version: "4",
+			Address: net.IPNet{IP: ip, Mask: mask},
+			Gateway: gw,
+		}},
+	}}
+	if ip.To4() == nil {
+		result.IPs[0].Version = "6"
+	}
+	if err = result.addRoutes(ip, network, conf, gw); err != nil {
+		return nil, err
+	}
+	result.DNS = resultDNS(network, conf)
+	return result, nil
+}
+
+// resultDNS return the dns of network, with each field overridden by the
+// DNS of conf if set
+func resultDNS(network *ippoolv1alpha1.IPPoolNetwork, conf *IPAMConf) (dns types.DNS) {
+	if network.DNS != nil {
+		dns.Nameservers = network.DNS.Nameservers
+		dns.Search = network.DNS.Search
+		dns.Options = network.DNS.Options
+	}
+	if conf.DNS == nil {
+		return
+	}
+	if len(conf.DNS.Nameservers) > 0 {
+		dns.Nameservers = conf.DNS.Nameservers
+	}
+	if conf.DNS.Domain != "" {
+		dns.Domain = conf.DNS.Domain
+	}
+	if len(conf.DNS.Search) > 0 {
+		dns.Search = conf.DNS.Search
+	}
+	if len(conf.DNS.Options) > 0 {
+		dns.Options = conf.DNS.Options
+	}
+	return
+}
+
+// resultMask return the Mask of conf, or else the prefix length of the cidr
+// of network, for ip
+func resultMask(ip net.IP, network *ippoolv1alpha1.IPPoolNetwork, conf *IPAMConf) (net.IPMask, error) {
+	if conf.Mask != "" {
+		raw := net.ParseIP(conf.Mask)
+		if raw == nil || !sameFamily(raw, ip) {
+			return nil, fmt.Errorf("cannot parse mask %q for %s", conf.Mask, ip)
+		}
+		mask := net.IPMask(raw.To16())
+		if ip.To4() != nil {
+			mask = net.IPMask(raw.To4())
+		}
+		if _, bits := mask.Size(); bits == 0 {
+			return nil, fmt.Errorf("mask %q is not contiguous", conf.Mask)
+		}
+		return mask, nil
+	}
+	if network.CIDR == "" {
+		return nil, fmt.Errorf("prefix length given by neither pool nor cni config")
+	}
+	_, ipnet, err := net.ParseCIDR(network.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	if !sameFamily(ipnet.IP, ip) {
+		return nil, fmt.Errorf("cidr %s is not of the family of %s", network.CIDR, ip)
+	}
+	return ipnet.Mask, nil
+}
+
+// addRoutes add the Routes of conf, or else the routes of network, to r,
+// which are all of the family of ip. A route without gateway goes via gw.
+// The default route via gw comes first, unless there is no gw, it is
+// disabled by conf or given among the routes.
+func (r *Result) addRoutes(ip net.IP, network *ippoolv1alpha1.IPPoolNetwork, conf *IPAMConf, gw net.IP) error {
+	routes := conf.Routes
+	if len(routes) == 0 {
+		for _, route := range network.Routes {
+			routes = append(routes, RouteConf{
+				Dst:    route.Dst,
+				GW:     route.Gateway,
+				Metric: int(route.Metric),
+			})
+		}
+	}
+
+	skipDefault := conf.DisableDefaultRoute || gw == nil
+	for _, route := range routes {
+		_, ipnet, err := net.ParseCIDR(route.Dst)
+		if err != nil {
+			return err
+		}
+		if !sameFamily(ipnet.IP, ip) {
+			return fmt.Errorf("route %s is not of the family of %s", route.Dst, ip)
+		}
+		routeGW := gw
+		if route.GW != "" {
+			if routeGW = net.ParseIP(route.GW); routeGW == nil {
+				return fmt.Errorf("cannot parse gateway %q of route %s", route.GW, route.Dst)
+			}
+			if !sameFamily(routeGW, ip) {
+				return fmt.Errorf("gateway %s of route %s is not of the family of %s", routeGW, route.Dst, ip)
+			}
+		}
+		if ones, _ := ipnet.Mask.Size(); ones == 0 {
+			skipDefault = true
+		}
+		r.Routes = append(r.Routes, &types.Route{Dst: *ipnet, GW: routeGW})
+		r.Metrics = append(r.Metrics, route.Metric)
+	}
+	if !skipDefault {
+		r.Routes = append([]*types.Route{{Dst: defaultRoute(ip), GW: gw}}, r.Routes...)
+		r.Metrics = append([]int{0}, r.Metrics...)
+	}
+	return nil
+}
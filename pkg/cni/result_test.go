@@ -0,0 +1,174 @@
+package cni
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	ippoolv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+func TestBuildResult(t *testing.T) {
+	ip := net.ParseIP("10.0.0.5")
+	network := &ippoolv1alpha1.IPPoolNetwork{
+		CIDR:    "10.0.0.0/24",
+		Gateway: "10.0.0.1",
+		Routes: []ippoolv1alpha1.IPRoute{
+			{Dst: "10.1.0.0/16"},
+			{Dst: "10.2.0.0/16", Gateway: "10.0.0.254"},
+		},
+		DNS: &ippoolv1alpha1.IPDNS{
+			Nameservers: []string{"10.0.0.53"},
+			Options:     []string{"ndots:5"},
+		},
+	}
+
+	result, err := BuildResult(ip, network, &IPAMConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := result.IPs[0].Address.String(); addr != "10.0.0.5/24" {
+		t.Errorf("expect 10.0.0.5/24, got %s", addr)
+	}
+	if len(result.Routes) != 3 || !result.Routes[1].GW.Equal(net.ParseIP("10.0.0.1")) ||
+		!result.Routes[2].GW.Equal(net.ParseIP("10.0.0.254")) {
+		t.Errorf("unexpected routes %v", result.Routes)
+	}
+	if len(result.DNS.Nameservers) != 1 || len(result.DNS.Options) != 1 {
+		t.Errorf("expect dns of pool, got %v", result.DNS)
+	}
+
+	conf := &IPAMConf{}
+	if err = json.Unmarshal([]byte(`{"mask": "255.255.0.0", "gateway": "10.0.0.2",
+		"routes": ["10.3.0.0/16"]}`), conf); err != nil {
+		t.Fatal(err)
+	}
+	result, err = BuildResult(ip, network, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := result.IPs[0].Address.String(); addr != "10.0.0.5/16" {
+		t.Errorf("expect mask of conf, got %s", addr)
+	}
+	if len(result.Routes) != 2 || result.Routes[1].Dst.String() != "10.3.0.0/16" ||
+		!result.Routes[1].GW.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expect routes of conf, got %v", result.Routes)
+	}
+
+	conf = &IPAMConf{DNS: &types.DNS{Nameservers: []string{"1.1.1.1"}, Search: []string{"svc"}}}
+	result, err = BuildResult(ip, network, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DNS.Nameservers[0] != "1.1.1.1" || result.DNS.Search[0] != "svc" ||
+		len(result.DNS.Options) != 1 {
+		t.Errorf("expect dns of conf over pool, got %v", result.DNS)
+	}
+
+	if _, err = BuildResult(ip, nil, &IPAMConf{}); err == nil {
+		t.Errorf("expect error without prefix length")
+	}
+}
+
+func TestBuildResultRoutes(t *testing.T) {
+	ip := net.ParseIP("10.0.0.5")
+	network := &ippoolv1alpha1.IPPoolNetwork{CIDR: "10.0.0.0/24", Gateway: "10.0.0.1"}
+	conf := &IPAMConf{}
+	if err := json.Unmarshal([]byte(`{"disableDefaultRoute": true, "routes": [
+		{"dst": "10.1.0.0/16", "gw": "10.0.0.254", "metric": 100},
+		"10.2.0.0/16"]}`), conf); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := BuildResult(ip, network, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Routes) != 2 || !result.Routes[0].GW.Equal(net.ParseIP("10.0.0.254")) ||
+		!result.Routes[1].GW.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("unexpected routes %v", result.Routes)
+	}
+
+	printed, err := result.GetAsVersion("0.4.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err = printed.PrintTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"priority": 100`) {
+		t.Errorf("metric not printed: %s", buf)
+	}
+
+	network.Routes = []ippoolv1alpha1.IPRoute{{Dst: "0.0.0.0/0", Gateway: "10.0.0.2", Metric: 10}}
+	result, err = BuildResult(ip, network, &IPAMConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Routes) != 1 || result.Metrics[0] != 10 {
+		t.Errorf("expect only the default route of pool, got %v %v", result.Routes, result.Metrics)
+	}
+}
+
+func TestBuildResultNoGateway(t *testing.T) {
+	network := &ippoolv1alpha1.IPPoolNetwork{CIDR: "10.0.0.0/24",
+		Routes: []ippoolv1alpha1.IPRoute{{Dst: "10.1.0.0/16", Gateway: "10.0.0.254"}}}
+	result, err := BuildResult(net.ParseIP("10.0.0.5"), network, &IPAMConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Routes) != 1 || result.Routes[0].Dst.String() != "10.1.0.0/16" {
+		t.Errorf("expect no default route without gateway, got %v", result.Routes)
+	}
+}
+
+func TestBuildResultIPv6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::5")
+	network := &ippoolv1alpha1.IPPoolNetwork{CIDR: "2001:db8::/64", Gateway: "2001:db8::1",
+		Routes: []ippoolv1alpha1.IPRoute{{Dst: "2001:db8:1::/48"}}}
+
+	result, err := BuildResult(ip, network, &IPAMConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := result.IPs[0].Address.String(); addr != "2001:db8::5/64" || result.IPs[0].Version != "6" {
+		t.Errorf("expect 2001:db8::5/64, got %s", addr)
+	}
+	if len(result.Routes) != 2 || result.Routes[0].Dst.String() != "::/0" ||
+		!result.Routes[1].GW.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("unexpected routes %v", result.Routes)
+	}
+
+	result, err = BuildResult(ip, network, &IPAMConf{Mask: "ffff:ffff:ffff::"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := result.IPs[0].Address.String(); addr != "2001:db8::5/48" {
+		t.Errorf("expect mask of conf, got %s", addr)
+	}
+
+	tests := []struct {
+		network ippoolv1alpha1.IPPoolNetwork
+		conf    IPAMConf
+	}{
+		// an ipv4 mask for an ipv6 address
+		{ippoolv1alpha1.IPPoolNetwork{}, IPAMConf{Mask: "255.255.255.0"}},
+		// a mask with holes
+		{ippoolv1alpha1.IPPoolNetwork{}, IPAMConf{Mask: "ffff::ffff"}},
+		// an ipv4 pool
+		{ippoolv1alpha1.IPPoolNetwork{CIDR: "10.0.0.0/24"}, IPAMConf{}},
+		// an ipv4 gateway
+		{ippoolv1alpha1.IPPoolNetwork{CIDR: "2001:db8::/64", Gateway: "10.0.0.1"}, IPAMConf{}},
+		// an ipv4 route
+		{ippoolv1alpha1.IPPoolNetwork{CIDR: "2001:db8::/64"}, IPAMConf{Routes: []RouteConf{{Dst: "10.1.0.0/16"}}}},
+	}
+	for _, test := range tests {
+		if _, err := BuildResult(ip, &test.network, &test.conf); err == nil {
+			t.Errorf("expect %v %v to fail for %s", test.network, test.conf, ip)
+		}
+	}
+}
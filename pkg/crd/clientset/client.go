@@ -6,6 +6,7 @@ import (
 	"log"
 
 	ipamv1alpha1 "github.com/jbliao/kubeipam/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -37,6 +38,11 @@ func NewForConfig(c *rest.Config, logger *log.Logger) (*IPPoolClient, error) {
 	return &IPPoolClient{Client: kubeclient, logger: logger}, nil
 }
 
+// NewForClient wrap the client c, e.g. a fake one in tests
+func NewForClient(c client.Client, logger *log.Logger) *IPPoolClient {
+	return &IPPoolClient{Client: c, logger: logger}
+}
+
 func (c *IPPoolClient) GetIPPool(namespace, name string) (*ipamv1alpha1.IPPool, error) {
 	pool := &ipamv1alpha1.IPPool{}
 	if err := c.Get(
@@ -49,3 +55,55 @@ func (c *IPPoolClient) GetIPPool(namespace, name string) (*ipamv1alpha1.IPPool,
 	}
 	return pool, nil
 }
+
+// GetPod get the pod with namespace and name
+func (c *IPPoolClient) GetPod(namespace, name string) (*corev1.Pod, error) {
+	pod := &corev1.Pod{}
+	if err := c.Get(
+		context.Background(),
+		types.NamespacedName{Name: name, Namespace: namespace},
+		pod,
+	); err != nil {
+		c.logger.Println(err)
+		return nil, err
+	}
+	return pod, nil
+}
+
+// GetNamespace get the namespace with name
+func (c *IPPoolClient) GetNamespace(name string) (*corev1.Namespace, error) {
+	ns := &corev1.Namespace{}
+	if err := c.Get(
+		context.Background(),
+		types.NamespacedName{Name: name},
+		ns,
+	); err != nil {
+		c.logger.Println(err)
+		return nil, err
+	}
+	return ns, nil
+}
+
+// GetNode get the node with name
+func (c *IPPoolClient) GetNode(name string) (*corev1.Node, error) {
+	node := &corev1.Node{}
+	if err := c.Get(
+		context.Background(),
+		types.NamespacedName{Name: name},
+		node,
+	); err != nil {
+		c.logger.Println(err)
+		return nil, err
+	}
+	return node, nil
+}
+
+// ListIPPools list the IPPools of every namespace
+func (c *IPPoolClient) ListIPPools() ([]ipamv1alpha1.IPPool, error) {
+	pools := &ipamv1alpha1.IPPoolList{}
+	if err := c.List(context.Background(), pools); err != nil {
+		c.logger.Println(err)
+		return nil, err
+	}
+	return pools.Items, nil
+}
@@ -0,0 +1,89 @@
+package driver
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+// DemandTracker track the allocation and release rate of a pool over a
+// rolling window, to predict how many addresses will be allocated soon
+type DemandTracker struct {
+	Window time.Duration
+
+	lock     sync.Mutex
+	known    map[string]struct{}
+	allocs   []time.Time
+	releases []time.Time
+	seeded   bool
+}
+
+// allocationKey identify an allocation across syncs
+func allocationKey(alct *v1alpha1.IPAllocation) string {
+	return alct.ContainerID + "/" + alct.Address
+}
+
+// Observe record the allocations appeared and gone since the last call.
+// Allocations are counted at their AllocatedAt if they have one. On the
+// first call only the allocations made within the window are counted.
+func (t *DemandTracker) Observe(allocations []v1alpha1.IPAllocation, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	current := map[string]struct{}{}
+	for idx := range allocations {
+		alct := &allocations[idx]
+		key := allocationKey(alct)
+		current[key] = struct{}{}
+		if _, ok := t.known[key]; ok {
+			continue
+		}
+		at := now
+		if alct.AllocatedAt != nil {
+			at = alct.AllocatedAt.Time
+		} else if !t.seeded {
+			continue
+		}
+		if now.Sub(at) < t.Window {
+			t.allocs = append(t.allocs, at)
+		}
+	}
+	for key := range t.known {
+		if _, ok := current[key]; !ok {
+			t.releases = append(t.releases, now)
+		}
+	}
+	t.known = current
+	t.seeded = true
+
+	t.allocs = trimBefore(t.allocs, now.Add(-t.Window))
+	t.releases = trimBefore(t.releases, now.Add(-t.Window))
+}
+
+// trimBefore drop the times before since
+func trimBefore(times []time.Time, since time.Time) []time.Time {
+	kept := times[:0]
+	for _, at := range times {
+		if !at.Before(since) {
+			kept = append(kept, at)
+		}
+	}
+	return kept
+}
+
+// Demand return how many more addresses are expected to be allocated than
+// released within horizon, at the rate seen in the window
+func (t *DemandTracker) Demand(horizon time.Duration) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.Window <= 0 {
+		return 0
+	}
+	surplus := float64(len(t.allocs) - len(t.releases))
+	if surplus <= 0 {
+		return 0
+	}
+	return int(math.Ceil(surplus * float64(horizon) / float64(t.Window)))
+}
@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+func TestDemandTracker(t *testing.T) {
+	now := time.Now()
+	allocations := func(count int, at *time.Time) (ret []v1alpha1.IPAllocation) {
+		for idx := 0; idx < count; idx++ {
+			alct := v1alpha1.IPAllocation{
+				Address:     fmt.Sprintf("10.0.0.%d", idx+1),
+				ContainerID: fmt.Sprint(idx),
+			}
+			if at != nil {
+				alct.AllocatedAt = &metav1.Time{Time: *at}
+			}
+			ret = append(ret, alct)
+		}
+		return
+	}
+
+	tracker := &DemandTracker{Window: time.Minute}
+	// allocations before the tracker started are not counted, unless they
+	// tell when they were made
+	old := now.Add(-time.Hour)
+	recent := now.Add(-10 * time.Second)
+	tracker.Observe(append(allocations(2, nil), allocations(4, &old)[2:]...), now)
+	if demand := tracker.Demand(30 * time.Second); demand != 0 {
+		t.Errorf("expect no demand at start, got %d", demand)
+	}
+	tracker = &DemandTracker{Window: time.Minute}
+	tracker.Observe(allocations(4, &recent), now)
+	if demand := tracker.Demand(30 * time.Second); demand != 2 {
+		t.Errorf("expect demand 2 of 4 allocations a minute in 30s, got %d", demand)
+	}
+
+	// 6 more allocations and 2 releases within the window
+	later := now.Add(20 * time.Second)
+	tracker.Observe(allocations(10, nil)[2:], later)
+	if demand := tracker.Demand(30 * time.Second); demand != 4 {
+		t.Errorf("expect demand 4 of net 8 allocations a minute in 30s, got %d", demand)
+	}
+
+	// nothing left in the window
+	tracker.Observe(allocations(10, nil)[2:], later.Add(2*time.Minute))
+	if demand := tracker.Demand(30 * time.Second); demand != 0 {
+		t.Errorf("expect no demand after window, got %d", demand)
+	}
+}
@@ -0,0 +1,172 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+// ForeignHolder is implemented by addresses which can tell that they are held
+// by something other than k8s in the external ipam
+type ForeignHolder interface {
+	// ForeignHolder return who holds the address outside k8s, or "" if it is
+	// free or held by k8s
+	ForeignHolder() string
+}
+
+// SpecificAddressCreator is implemented by drivers which can create a given
+// address, not only the next available one
+type SpecificAddressCreator interface {
+	// CreateAddressAt create the address ip in the pool
+	CreateAddressAt(ip net.IP) error
+}
+
+// Reclaimer is implemented by drivers which can take an address back from
+// who holds it outside k8s
+type Reclaimer interface {
+	// Reclaim clear the status, interface and allocation marks of addr set
+	// outside k8s, leaving it a free address of the pool
+	Reclaim(addr IpamAddress) error
+}
+
+// ErrUnsupported is returned by drivers which implement an optional interface
+// but cannot serve it, e.g. a plugin whose driver lacks it
+var ErrUnsupported = errors.New("not supported by driver")
+
+// DriftKind tells how a pool and its external ipam disagree
+type DriftKind string
+
+const (
+	// DriftMissing is an allocation of pool whose address is not in the driver
+	DriftMissing DriftKind = "Missing"
+	// DriftForeign is an address of pool held outside k8s
+	DriftForeign DriftKind = "Foreign"
+)
+
+// Drift is a disagreement found by Sync
+type Drift struct {
+	Kind    DriftKind
+	Address string
+	// Allocation is the allocation of address in pool, if any
+	Allocation *v1alpha1.IPAllocation
+	// Holder is who holds a foreign address
+	Holder string
+}
+
+func (d Drift) String() string {
+	owner := "unallocated"
+	if d.Allocation != nil {
+		owner = "allocated to " + d.Allocation.PodNamespace + "/" + d.Allocation.PodName
+	}
+	switch d.Kind {
+	case DriftMissing:
+		return fmt.Sprintf("address %s %s is missing in ipam", d.Address, owner)
+	case DriftForeign:
+		return fmt.Sprintf("address %s %s is held by %s in ipam", d.Address, owner, d.Holder)
+	}
+	return fmt.Sprintf("address %s %s drifted", d.Address, owner)
+}
+
+// findAllocation return the allocation of address ip, or nil
+func findAllocation(allocations []v1alpha1.IPAllocation, ip net.IP) *v1alpha1.IPAllocation {
+	for idx := range allocations {
+		if ip.Equal(net.ParseIP(allocations[idx].Address)) {
+			return &allocations[idx]
+		}
+	}
+	return nil
+}
+
+// detectDrift compare the addresses of driver with the allocations of pool
+func detectDrift(addrs []IpamAddress, allocations []v1alpha1.IPAllocation) (drifts []Drift) {
+	for idx := range allocations {
+		alct := &allocations[idx]
+		ip := net.ParseIP(alct.Address)
+		found := false
+		for _, addr := range addrs {
+			if ip != nil && addr.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			drifts = append(drifts, Drift{
+				Kind: DriftMissing, Address: alct.Address, Allocation: alct})
+		}
+	}
+
+	for _, addr := range addrs {
+		holder, ok := addr.(ForeignHolder)
+		if !ok || holder.ForeignHolder() == "" {
+			continue
+		}
+		drifts = append(drifts, Drift{
+			Kind:       DriftForeign,
+			Address:    addr.String(),
+			Allocation: findAllocation(allocations, net.ParseIP(addr.String())),
+			Holder:     holder.ForeignHolder(),
+		})
+	}
+	return
+}
+
+// repairMissing create the missing addresses of drifts, and return the
+// addresses of driver after it
+func repairMissing(d Driver, drifts []Drift, addrs []IpamAddress, logger *log.Logger) ([]IpamAddress, error) {
+	creator, ok := d.(SpecificAddressCreator)
+	repaired := false
+	for _, drift := range drifts {
+		if drift.Kind != DriftMissing {
+			continue
+		}
+		if !ok {
+			logger.Printf("driver cannot repair: %s", drift)
+			continue
+		}
+		err := creator.CreateAddressAt(net.ParseIP(drift.Address))
+		if errors.Is(err, ErrUnsupported) {
+			logger.Printf("driver cannot repair: %s", drift)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		repaired = true
+	}
+	if !repaired {
+		return addrs, nil
+	}
+	return d.GetAddresses()
+}
+
+// reclaimForeign take back the foreign addresses of drifts, and return those
+// which cannot be
+func reclaimForeign(d Driver, drifts []Drift, addrs []IpamAddress, logger *log.Logger) (map[string]bool, error) {
+	foreign := map[string]bool{}
+	reclaimer, ok := d.(Reclaimer)
+	for _, drift := range drifts {
+		if drift.Kind != DriftForeign {
+			continue
+		}
+		if !ok {
+			logger.Printf("driver cannot reclaim: %s", drift)
+			foreign[drift.Address] = true
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.String() == drift.Address {
+				err := reclaimer.Reclaim(addr)
+				if errors.Is(err, ErrUnsupported) {
+					logger.Printf("driver cannot reclaim: %s", drift)
+					foreign[drift.Address] = true
+				} else if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+	return foreign, nil
+}
@@ -0,0 +1,162 @@
+package driver
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+type fakeAddress struct {
+	net.IP
+	marks  map[string]bool
+	holder string
+}
+
+func (a *fakeAddress) MarkedWith(mark string) bool { return a.marks[mark] }
+func (a *fakeAddress) ForeignHolder() string       { return a.holder }
+
+// fakeDriver keeps the addresses in memory
+type fakeDriver struct {
+	addrs     []*fakeAddress
+	touched   map[string]bool
+	reclaimed map[string]bool
+}
+
+func newFakeDriver(addrs ...*fakeAddress) *fakeDriver {
+	return &fakeDriver{addrs: addrs, touched: map[string]bool{}, reclaimed: map[string]bool{}}
+}
+
+func (d *fakeDriver) GetAddresses() (ret []IpamAddress, err error) {
+	for _, addr := range d.addrs {
+		ret = append(ret, addr)
+	}
+	return
+}
+
+func (d *fakeDriver) MarkAddressAllocated(addr IpamAddress, alct *v1alpha1.IPAllocation) error {
+	d.touched[addr.String()] = true
+	addr.(*fakeAddress).marks[Allocated] = true
+	return nil
+}
+
+func (d *fakeDriver) MarkAddressReleased(addr IpamAddress) error {
+	d.touched[addr.String()] = true
+	addr.(*fakeAddress).marks[Allocated] = false
+	return nil
+}
+
+func (d *fakeDriver) Reclaim(addr IpamAddress) error {
+	d.reclaimed[addr.String()] = true
+	addr.(*fakeAddress).holder = ""
+	return nil
+}
+
+func (d *fakeDriver) CreateAddress(count int) error { return nil }
+
+func (d *fakeDriver) CreateAddressAt(ip net.IP) error {
+	d.addrs = append(d.addrs, &fakeAddress{IP: ip, marks: map[string]bool{Automated: true}})
+	return nil
+}
+
+func (d *fakeDriver) DeleteAddress(addr IpamAddress) error {
+	for idx, a := range d.addrs {
+		if a == addr {
+			d.addrs = append(d.addrs[:idx], d.addrs[idx+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (d *fakeDriver) SetPoolID(string)      {}
+func (d *fakeDriver) SetLogger(*log.Logger) {}
+
+func TestSyncDrift(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	for _, policy := range []v1alpha1.DriftPolicy{
+		"", v1alpha1.DriftPolicyRepair, v1alpha1.DriftPolicyQuarantine,
+	} {
+		d := newFakeDriver(
+			&fakeAddress{IP: net.ParseIP("10.0.0.1"), marks: map[string]bool{Automated: true}},
+			&fakeAddress{IP: net.ParseIP("10.0.0.2"), marks: map[string]bool{Automated: true},
+				holder: "interface 3"},
+		)
+		spec := &v1alpha1.IPPoolSpec{
+			Addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			Allocations: []v1alpha1.IPAllocation{
+				{Address: "10.0.0.1", PodName: "a", PodNamespace: "default"},
+				{Address: "10.0.0.3", PodName: "b", PodNamespace: "default"},
+			},
+			DriftPolicy: policy,
+		}
+
+		drifts, err := Sync(d, spec, 0, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(drifts) != 2 ||
+			drifts[0].Kind != DriftMissing || drifts[0].Address != "10.0.0.3" ||
+			drifts[1].Kind != DriftForeign || drifts[1].Holder != "interface 3" {
+			t.Fatalf("policy %q: unexpected drifts %v", policy, drifts)
+		}
+
+		repaired := d.touched["10.0.0.3"]
+		taken := d.reclaimed["10.0.0.2"]
+		quarantined := true
+		for _, addr := range spec.Addresses {
+			if addr == "10.0.0.2" {
+				quarantined = false
+			}
+		}
+		switch policy {
+		case v1alpha1.DriftPolicyRepair:
+			if !repaired || !taken || quarantined {
+				t.Errorf("policy Repair: repaired %v, taken %v, quarantined %v",
+					repaired, taken, quarantined)
+			}
+		case v1alpha1.DriftPolicyQuarantine:
+			if repaired || taken || !quarantined {
+				t.Errorf("policy Quarantine: repaired %v, taken %v, quarantined %v",
+					repaired, taken, quarantined)
+			}
+		default:
+			if repaired || taken || quarantined {
+				t.Errorf("policy Warn: repaired %v, taken %v, quarantined %v",
+					repaired, taken, quarantined)
+			}
+		}
+	}
+}
+
+// unsupportedDriver implements the optional interfaces but cannot serve them,
+// as a plugin whose driver lacks them
+type unsupportedDriver struct {
+	*fakeDriver
+}
+
+func (d *unsupportedDriver) Reclaim(IpamAddress) error    { return ErrUnsupported }
+func (d *unsupportedDriver) CreateAddressAt(net.IP) error { return ErrUnsupported }
+
+func TestSyncRepairUnsupported(t *testing.T) {
+	d := &unsupportedDriver{newFakeDriver(
+		&fakeAddress{IP: net.ParseIP("10.0.0.2"), marks: map[string]bool{Automated: true},
+			holder: "interface 3"},
+	)}
+	spec := &v1alpha1.IPPoolSpec{
+		Addresses: []string{"10.0.0.2", "10.0.0.3"},
+		Allocations: []v1alpha1.IPAllocation{
+			{Address: "10.0.0.3", PodName: "b", PodNamespace: "default"},
+		},
+		DriftPolicy: v1alpha1.DriftPolicyRepair,
+	}
+	drifts, err := Sync(d, spec, 0, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("expect unsupported repair only reported, got %v", err)
+	}
+	if len(drifts) != 2 || len(d.addrs) != 1 || d.addrs[0].holder == "" {
+		t.Errorf("expect nothing repaired, got %v %v", drifts, d.addrs)
+	}
+}
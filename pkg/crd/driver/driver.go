@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/jbliao/kubeipam/api/v1alpha1"
 )
@@ -13,6 +14,9 @@ const (
 	Automated = "k8s-automated"
 	// Allocated indicate that the address is used by pod
 	Allocated = "k8s-allocated"
+	// Adopted indicate that the address existed before and was claimed into
+	// the pool, it is never deleted by k8s
+	Adopted = "k8s-adopted"
 )
 
 // IpamAddress define interface that ip address of driver need impl
@@ -22,7 +26,65 @@ type IpamAddress interface {
 	String() string
 }
 
-const reserveAddressCount int = 1
+// defaultMinFree is the MinFree of pools which leave it unset
+const defaultMinFree int = 1
+
+// freeBounds return the MinFree and MaxFree of spec with defaults applied
+func freeBounds(spec *v1alpha1.IPPoolSpec) (minFree, maxFree int) {
+	minFree = defaultMinFree
+	if spec.MinFree != nil {
+		minFree = int(*spec.MinFree)
+	}
+	maxFree = minFree
+	if spec.MaxFree != nil {
+		maxFree = int(*spec.MaxFree)
+	}
+	if maxFree < minFree {
+		maxFree = minFree
+	}
+	return
+}
+
+// unavailableCount return how many unallocated addresses of spec are in
+// cooldown or reserved
+func unavailableCount(spec *v1alpha1.IPPoolSpec) (count int) {
+	if len(spec.Cooling) == 0 && len(spec.Reservations) == 0 {
+		return
+	}
+	allocated := map[string]bool{}
+	for _, alct := range spec.Allocations {
+		allocated[alct.Address] = true
+	}
+	now := time.Now()
+	for _, addr := range spec.Addresses {
+		if !allocated[addr] && (spec.IsCooling(addr, now) || spec.IsReserved(addr)) {
+			count++
+		}
+	}
+	return
+}
+
+// poolSizeDiff return how many addresses the pool has more than it needs, or
+// less if negative. Addresses in cooldown or reserved are not counted as
+// free. The pool is resized to halfway between MinFree and MaxFree, both
+// raised by demand, only when its free count leaves them, and never beyond
+// MaxSize.
+func poolSizeDiff(spec *v1alpha1.IPPoolSpec, demand int) int {
+	size := len(spec.Addresses)
+	free := size - len(spec.Allocations) - unavailableCount(spec)
+	minFree, maxFree := freeBounds(spec)
+	minFree, maxFree = minFree+demand, maxFree+demand
+	target := (minFree + maxFree + 1) / 2
+
+	diff := 0
+	if free < minFree || free > maxFree {
+		diff = free - target
+	}
+	if maxSize := int(spec.MaxSize); maxSize > 0 && size-diff > maxSize {
+		diff = size - maxSize
+	}
+	return diff
+}
 
 // Driver for ipam syncing
 type Driver interface {
@@ -30,7 +92,7 @@ type Driver interface {
 	GetAddresses() ([]IpamAddress, error)
 
 	// MarkAddressAllocated ensures that allocation is mark allocated in the ipam
-	MarkAddressAllocated(addr IpamAddress, des string) error
+	MarkAddressAllocated(addr IpamAddress, alct *v1alpha1.IPAllocation) error
 
 	// MarkAddressReleased do the reverse
 	MarkAddressReleased(addr IpamAddress) error
@@ -45,46 +107,86 @@ type Driver interface {
 	SetLogger(*log.Logger)
 }
 
-// Sync sync the allocations in spec with the pool identified by spec.Network
+// UsageReporter is implemented by drivers which can report the utilization
+// of the prefixes backing a pool
+type UsageReporter interface {
+	// Usage return the usage seen by the last GetAddresses
+	Usage() []v1alpha1.PrefixUsage
+}
+
+// Sync sync the allocations in spec with the pool identified by spec.Network.
+// The drifts found between them are returned, and handled as
+// spec.DriftPolicy says. demand is the count of addresses expected to be
+// allocated soon, see DemandTracker.
 // TODO: rewrite the logic for more efficiency
-func Sync(d Driver, spec *v1alpha1.IPPoolSpec, logger *log.Logger) error {
+func Sync(d Driver, spec *v1alpha1.IPPoolSpec, demand int, logger *log.Logger) (drifts []Drift, err error) {
 
 	logger.Println("Sync start")
 	specAddressListSize := len(spec.Addresses)
 	specAllocationListSize := len(spec.Allocations)
-	sizeDiff := specAddressListSize - specAllocationListSize - reserveAddressCount
-	logger.Printf("address count=%d, allocation count=%d, reserve count=%d",
-		specAddressListSize, specAllocationListSize, reserveAddressCount)
+	minFree, maxFree := freeBounds(spec)
+	sizeDiff := poolSizeDiff(spec, demand)
+	logger.Printf("address count=%d, allocation count=%d, free bounds=[%d, %d], demand=%d, max size=%d",
+		specAddressListSize, specAllocationListSize, minFree, maxFree, demand, spec.MaxSize)
 
 	if sizeDiff < 0 {
 		// need more address
 		logger.Printf("need %d more address. creating...", -sizeDiff)
-		if err := d.CreateAddress(-sizeDiff); err != nil {
-			return err
+		if err = d.CreateAddress(-sizeDiff); err != nil {
+			return
 		}
 	}
 
 	ipamAddrLst, err := d.GetAddresses()
 	if err != nil {
-		return err
+		return
+	}
+
+	drifts = detectDrift(ipamAddrLst, spec.Allocations)
+	for _, drift := range drifts {
+		logger.Printf("drift: %s", drift)
+	}
+	// foreign held addresses are only touched once reclaimed
+	foreign := map[string]bool{}
+	if spec.DriftPolicy == v1alpha1.DriftPolicyRepair {
+		if foreign, err = reclaimForeign(d, drifts, ipamAddrLst, logger); err != nil {
+			return
+		}
+		if ipamAddrLst, err = repairMissing(d, drifts, ipamAddrLst, logger); err != nil {
+			return
+		}
+	} else {
+		for _, drift := range drifts {
+			if drift.Kind == DriftForeign {
+				foreign[drift.Address] = true
+			}
+		}
 	}
 
 	if sizeDiff > 0 {
 		logger.Println("too many address. deleting unallocated address...")
-		tmpList := []IpamAddress{}
+		// the driver may not have marked the allocations of spec yet, e.g.
+		// the ones just handed out by the CNI
+		allocated := map[string]bool{}
+		for _, alct := range spec.Allocations {
+			allocated[alct.Address] = true
+		}
+		now := time.Now()
+		kept := []IpamAddress{}
 		for _, ipamAddr := range ipamAddrLst {
-			if !ipamAddr.MarkedWith(Allocated) && ipamAddr.MarkedWith(Automated) {
+			addr := ipamAddr.String()
+			if sizeDiff > 0 && !ipamAddr.MarkedWith(Allocated) && !allocated[addr] &&
+				ipamAddr.MarkedWith(Automated) && !ipamAddr.MarkedWith(Adopted) &&
+				!foreign[addr] && !spec.IsReserved(addr) && !spec.IsCooling(addr, now) {
 				if err = d.DeleteAddress(ipamAddr); err != nil {
-					return err
+					return
 				}
 				sizeDiff--
+				continue
 			}
-			tmpList = append(tmpList, ipamAddr)
-			if sizeDiff <= 0 {
-				break
-			}
+			kept = append(kept, ipamAddr)
 		}
-		ipamAddrLst = tmpList
+		ipamAddrLst = kept
 	}
 
 	// Sync addresses
@@ -92,6 +194,9 @@ func Sync(d Driver, spec *v1alpha1.IPPoolSpec, logger *log.Logger) error {
 	logger.Println("Copying IpamAddr to AddressList")
 	spec.Addresses = []string{}
 	for _, ipamAddr := range ipamAddrLst {
+		if foreign[ipamAddr.String()] && spec.DriftPolicy == v1alpha1.DriftPolicyQuarantine {
+			continue
+		}
 		spec.Addresses = append(spec.Addresses, ipamAddr.String())
 	}
 
@@ -99,6 +204,9 @@ func Sync(d Driver, spec *v1alpha1.IPPoolSpec, logger *log.Logger) error {
 	// Every allocations in ippool is force sync to driver now.
 	logger.Println("Mark allocation addresses alocated.")
 	for _, ipamAddr := range ipamAddrLst {
+		if foreign[ipamAddr.String()] {
+			continue
+		}
 		var toRelease bool = true
 		var alct *v1alpha1.IPAllocation
 		for _, alction := range spec.Allocations {
@@ -107,7 +215,7 @@ func Sync(d Driver, spec *v1alpha1.IPPoolSpec, logger *log.Logger) error {
 				err = fmt.Errorf("sync failed: cannot parse address %v",
 					spec.Addresses)
 				logger.Println(err)
-				return err
+				return
 			}
 			alct = &alction
 			if ipamAddr.Equal(ip) {
@@ -115,15 +223,14 @@ func Sync(d Driver, spec *v1alpha1.IPPoolSpec, logger *log.Logger) error {
 				break
 			}
 		}
-		var err error
 		if toRelease {
 			err = d.MarkAddressReleased(ipamAddr)
 		} else {
-			err = d.MarkAddressAllocated(ipamAddr, alct.PodNamespace+"/"+alct.PodName)
+			err = d.MarkAddressAllocated(ipamAddr, alct)
 		}
 		if err != nil {
-			return err
+			return
 		}
 	}
-	return nil
+	return
 }
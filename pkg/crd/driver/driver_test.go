@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+func TestPoolSizeDiff(t *testing.T) {
+	int32p := func(v int32) *int32 { return &v }
+	for _, c := range []struct {
+		size, allocated int
+		minFree         *int32
+		maxFree         *int32
+		maxSize         int32
+		diff            int
+	}{
+		// default keep exactly 1 free
+		{0, 0, nil, nil, 0, -1},
+		{2, 1, nil, nil, 0, 0},
+		{3, 1, nil, nil, 0, 1},
+		{5, 1, nil, nil, 0, 3},
+		// inside the bounds nothing changes
+		{10, 5, int32p(4), int32p(8), 0, 0},
+		{13, 5, int32p(4), int32p(8), 0, 0},
+		// outside them resize to halfway
+		{7, 5, int32p(4), int32p(8), 0, -4},
+		{20, 5, int32p(4), int32p(8), 0, 9},
+		// never beyond max size
+		{7, 5, int32p(4), int32p(8), 10, -3},
+		{12, 11, nil, nil, 10, 2},
+		// no spare at all
+		{3, 3, int32p(0), int32p(0), 0, 0},
+	} {
+		spec := &v1alpha1.IPPoolSpec{
+			Addresses:   make([]string, c.size),
+			Allocations: make([]v1alpha1.IPAllocation, c.allocated),
+			MinFree:     c.minFree,
+			MaxFree:     c.maxFree,
+			MaxSize:     c.maxSize,
+		}
+		if diff := poolSizeDiff(spec, 0); diff != c.diff {
+			t.Errorf("size %d, allocated %d, bounds %v %v, max %d: expect diff %d, got %d",
+				c.size, c.allocated, c.minFree, c.maxFree, c.maxSize, c.diff, diff)
+		}
+	}
+}
+
+func TestPoolSizeDiffCooling(t *testing.T) {
+	now := time.Now()
+	spec := &v1alpha1.IPPoolSpec{
+		Addresses:   []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		Allocations: []v1alpha1.IPAllocation{{Address: "10.0.0.1"}},
+		Cooling: map[string]metav1.Time{
+			"10.0.0.2": metav1.NewTime(now.Add(time.Minute)),
+			"10.0.0.3": metav1.NewTime(now.Add(-time.Minute)),
+		},
+	}
+	// only 10.0.0.3 is free, within the default bounds
+	if diff := poolSizeDiff(spec, 0); diff != 0 {
+		t.Errorf("expect no resize, got %d", diff)
+	}
+	// with 10.0.0.3 cooling too, the pool grows to 1 free
+	spec.Cooling["10.0.0.3"] = metav1.NewTime(now.Add(time.Minute))
+	if diff := poolSizeDiff(spec, 0); diff != -1 {
+		t.Errorf("expect growing by 1, got %d", diff)
+	}
+
+	spec.Addresses = spec.Addresses[:2]
+	if !spec.SweepCooling(now.Add(2*time.Minute)) || spec.Cooling != nil {
+		t.Errorf("expired and gone addresses not swept: %v", spec.Cooling)
+	}
+}
+
+func TestSyncShrink(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	automated := func(ip string, marks ...string) *fakeAddress {
+		addr := &fakeAddress{IP: net.ParseIP(ip), marks: map[string]bool{Automated: true}}
+		for _, mark := range marks {
+			addr.marks[mark] = true
+		}
+		return addr
+	}
+	d := newFakeDriver(
+		automated("10.0.0.1", Allocated),
+		automated("10.0.0.2"),
+		automated("10.0.0.3"),
+		automated("10.0.0.4"),
+		automated("10.0.0.5", Allocated),
+	)
+	spec := &v1alpha1.IPPoolSpec{
+		Addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"},
+		Allocations: []v1alpha1.IPAllocation{
+			{Address: "10.0.0.1"}, {Address: "10.0.0.5"},
+		},
+	}
+
+	if _, err := Sync(d, spec, 0, logger); err != nil {
+		t.Fatal(err)
+	}
+	// 2 of the 3 free addresses are deleted, the allocated ones after them kept
+	expect := []string{"10.0.0.1", "10.0.0.4", "10.0.0.5"}
+	if len(spec.Addresses) != len(expect) {
+		t.Fatalf("expect addresses %v, got %v", expect, spec.Addresses)
+	}
+	for idx, addr := range expect {
+		if spec.Addresses[idx] != addr {
+			t.Errorf("expect addresses %v, got %v", expect, spec.Addresses)
+			break
+		}
+	}
+	if len(d.addrs) != 3 {
+		t.Errorf("expect 3 addresses left in driver, got %v", d.addrs)
+	}
+}
+
+func TestSyncShrinkKeepsUnavailable(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	automated := func(ip string) *fakeAddress {
+		return &fakeAddress{IP: net.ParseIP(ip), marks: map[string]bool{Automated: true}}
+	}
+	// 10.0.0.1 is just allocated by the CNI, not yet marked in driver, and
+	// 10.0.0.2 is cooling
+	d := newFakeDriver(
+		automated("10.0.0.1"),
+		automated("10.0.0.2"),
+		automated("10.0.0.3"),
+		automated("10.0.0.4"),
+		automated("10.0.0.5"),
+	)
+	spec := &v1alpha1.IPPoolSpec{
+		Addresses:   []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"},
+		Allocations: []v1alpha1.IPAllocation{{Address: "10.0.0.1"}},
+		Cooling: map[string]metav1.Time{
+			"10.0.0.2": metav1.NewTime(time.Now().Add(time.Minute)),
+		},
+	}
+
+	if _, err := Sync(d, spec, 0, logger); err != nil {
+		t.Fatal(err)
+	}
+	// 3 are free, 2 of them are deleted
+	expect := []string{"10.0.0.1", "10.0.0.2", "10.0.0.5"}
+	if len(spec.Addresses) != len(expect) {
+		t.Fatalf("expect addresses %v, got %v", expect, spec.Addresses)
+	}
+	for idx, addr := range expect {
+		if spec.Addresses[idx] != addr {
+			t.Errorf("expect addresses %v, got %v", expect, spec.Addresses)
+			break
+		}
+	}
+}
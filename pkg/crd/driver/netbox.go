@@ -1,24 +1,47 @@
 package driver
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net"
+	"strings"
 
-	"github.com/go-openapi/runtime"
 	runtimeclient "github.com/go-openapi/runtime/client"
-	"github.com/netbox-community/go-netbox/netbox"
 	"github.com/netbox-community/go-netbox/netbox/client"
 	"github.com/netbox-community/go-netbox/netbox/client/ipam"
-	"github.com/netbox-community/go-netbox/netbox/models"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+const (
+	// netboxStatusActive is the netbox status of an allocated address
+	netboxStatusActive = "active"
+	// netboxStatusReserved is the netbox status of a free address of pool
+	netboxStatusReserved = "reserved"
+
+	// Custom fields of ip address used when NetboxDriverConfig.UseStatus is
+	// set. They need to be created in netbox by admin in advance.
+	netboxFieldPool        = "k8s_pool"
+	netboxFieldPod         = "k8s_pod"
+	netboxFieldNamespace   = "k8s_namespace"
+	netboxFieldContainerID = "k8s_container_id"
+
+	// netboxPoolTagPrefix followed by the pool id tags the addresses of pool
+	netboxPoolTagPrefix = "k8s-pool-"
 )
 
 // NetboxIPAddress ...
 type NetboxIPAddress struct {
 	net.IP
-	tagset      map[string]interface{}
-	origin      *models.IPAddress
-	description string
+	tagset       map[string]interface{}
+	origin       *netboxAddress
+	description  string
+	customFields map[string]interface{}
+
+	// foreignHolder is who holds the address outside k8s, see ForeignHolder
+	foreignHolder string
 }
 
 // MarkedWith impl IpamAddress.MarkedWith with netbox tag feature
@@ -49,15 +72,69 @@ func (nba *NetboxIPAddress) hasTag(tag string) bool {
 	return ok
 }
 
+// ForeignHolder impl ForeignHolder
+func (nba *NetboxIPAddress) ForeignHolder() string {
+	return nba.foreignHolder
+}
+
+// status return the netbox status of address, or "" if unset
+func (nba *NetboxIPAddress) status() string {
+	if nba.origin.Status == nil {
+		return ""
+	}
+	return nba.origin.Status.Value
+}
+
+// customField return the value of custom field key as string, or "" if unset
+func (nba *NetboxIPAddress) customField(key string) string {
+	if value, ok := nba.customFields[key].(string); ok {
+		return value
+	}
+	return ""
+}
+
 // Make sure the NetboxIPAddress struct satisfy the IpamAddress interface
 var _ IpamAddress = &NetboxIPAddress{}
+var _ ForeignHolder = &NetboxIPAddress{}
 
 // NetboxDriver impl the Driver interface with netbox support
 type NetboxDriver struct {
-	client *client.NetBox
-	logger *log.Logger
-	prefix string
-	poolID string
+	client    *client.NetBox
+	logger    *log.Logger
+	prefixes  []string
+	poolID    string
+	useStatus bool
+
+	// scope is the query to narrow down prefix lookup, prefixObjs caches
+	// the prefixes found
+	scope      map[string]string
+	prefixObjs map[string]*netboxPrefix
+
+	// dnsNameTemplate is NetboxDriverConfig.DNSNameTemplate
+	dnsNameTemplate string
+
+	// adopt is NetboxDriverConfig.Adopt
+	adopt *NetboxAdoptSelector
+
+	// assignment is NetboxDriverConfig.Assignment, assignParent caches the
+	// virtual machine or device of it
+	assignment   *NetboxAssignment
+	assignParent *netboxRef
+
+	// usage is collected by getAddresses, keyed by prefix
+	usage map[string]*v1alpha1.PrefixUsage
+
+	// version is detected on first use, see getVersion
+	version   *netboxVersion
+	knownTags map[string]struct{}
+}
+
+// NetboxAdoptSelector select the existing addresses to adopt into a pool
+type NetboxAdoptSelector struct {
+	// Tags are the slugs of tags the address need to have all of
+	Tags []string `json:"tags"`
+	// Status, if set, is the status the address need to be in
+	Status string `json:"status"`
 }
 
 // NetboxDriverConfig contains the connection info to a netbox service
@@ -66,24 +143,142 @@ type NetboxDriverConfig struct {
 	APIKey string `json:"apiKey"`
 	Debug  bool   `json:"debug"`
 	Prefix string `json:"prefix"`
+
+	// Prefixes lists more prefixes of the pool in priority order. Addresses
+	// are created in the first one which has space left. Prefix, if set,
+	// comes first.
+	Prefixes []string `json:"prefixes"`
+
+	// UseStatus make the driver keep the allocation state in the status of
+	// address (active/reserved) and the pool and pod info in custom fields,
+	// instead of rewriting the tags of address. Only the Automated tag is
+	// still set, at creation.
+	UseStatus bool `json:"useStatus"`
+
+	// VRF, Tenant, Site and Role narrow down the prefix lookup, for the
+	// prefixes which overlap in different VRFs. VRF is the route
+	// distinguisher, the others are slugs. The VRF and tenant of the chosen
+	// prefix are set on the created addresses as well.
+	VRF    string `json:"vrf"`
+	Tenant string `json:"tenant"`
+	Site   string `json:"site"`
+	Role   string `json:"role"`
+
+	// Scheme is "http" (default) or "https"
+	Scheme string `json:"scheme"`
+	// InsecureSkipVerify disable the verification of netbox certificate
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+	// CARef refer to the PEM bundle to verify netbox certificate with
+	CARef *NetboxKeyRef `json:"caRef"`
+	// ClientCertRef and ClientKeyRef refer to the PEM client certificate and
+	// key presented to netbox
+	ClientCertRef *NetboxKeyRef `json:"clientCertRef"`
+	ClientKeyRef  *NetboxKeyRef `json:"clientKeyRef"`
+	// Proxy is the url of http proxy to reach netbox through. The proxy
+	// environment variables are used if empty.
+	Proxy string `json:"proxy"`
+
+	// RateLimit is the requests per second allowed to the host, with bursts
+	// of RateBurst. They are shared by every pool on the same host, the burst
+	// of the first pool seen is used.
+	RateLimit float64 `json:"rateLimit"`
+	RateBurst int     `json:"rateBurst"`
+	// MaxRetries is how many times an idempotent request is retried on
+	// connection errors, 429 and 5xx, and a POST on 429 and failed dials.
+	// Default to 3, 0 disable retries.
+	MaxRetries *int `json:"maxRetries"`
+
+	// DNSNameTemplate is rendered into the dns name of allocated addresses,
+	// e.g. "{{pod}}.{{namespace}}.k8s.example.com". {{pool}} is supported
+	// too. The dns name is left alone if empty.
+	DNSNameTemplate string `json:"dnsNameTemplate"`
+
+	// Adopt, if set, claims the addresses in the prefixes matching it into
+	// the pool, e.g. the addresses of workload moved onto k8s. The adopted
+	// addresses are tagged Adopted and never deleted by k8s.
+	Adopt *NetboxAdoptSelector `json:"adopt"`
+
+	// Assignment, if set, make the driver model pods as interfaces of a
+	// virtual machine or device and assign the addresses to them
+	Assignment *NetboxAssignment `json:"assignment"`
+
+	// data of the refs, loaded by ResolveRefs
+	caData   []byte
+	certData []byte
+	keyData  []byte
+}
+
+// allPrefixes return every prefix of config in priority order
+func (config *NetboxDriverConfig) allPrefixes() (prefixes []string) {
+	if config.Prefix != "" {
+		prefixes = append(prefixes, config.Prefix)
+	}
+	return append(prefixes, config.Prefixes...)
+}
+
+// scope return the query to narrow down the prefix lookup
+func (config *NetboxDriverConfig) scope() map[string]string {
+	filter := map[string]string{}
+	for name, value := range map[string]string{
+		"vrf":    config.VRF,
+		"tenant": config.Tenant,
+		"site":   config.Site,
+		"role":   config.Role,
+	} {
+		if value != "" {
+			filter[name] = value
+		}
+	}
+	return filter
 }
 
 // NewNetboxDriver construct a NetboxDriver instance with config
 func NewNetboxDriver(config *NetboxDriverConfig) (nd *NetboxDriver, err error) {
 
-	if config.Prefix == "" {
+	prefixes := config.allPrefixes()
+	if len(prefixes) == 0 {
 		err = fmt.Errorf("empty prefix")
 		return
-	} else if _, _, err = net.ParseCIDR(config.Prefix); err != nil {
-		// Prefix needs to satisfy cidr format
+	}
+	for _, prefix := range prefixes {
+		if _, _, err = net.ParseCIDR(prefix); err != nil {
+			// Prefix needs to satisfy cidr format
+			log.Println(err)
+			return
+		}
+	}
+
+	if config.Adopt != nil && len(config.Adopt.Tags) == 0 {
+		err = fmt.Errorf("adopt selector needs at least one tag")
+		log.Println(err)
+		return
+	}
+	if config.Assignment != nil {
+		if err = config.Assignment.validate(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	netboxClient, err := getNetboxClient(config)
+	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	nd = &NetboxDriver{
-		prefix: config.Prefix,
-		logger: log.New(log.Writer(), "Netbox", log.Flags()),
-		client: netbox.NewNetboxWithAPIKey(config.Host, config.APIKey),
+		prefixes:  prefixes,
+		logger:    log.New(log.Writer(), "Netbox", log.Flags()),
+		client:    netboxClient,
+		useStatus: config.UseStatus,
+
+		dnsNameTemplate: config.DNSNameTemplate,
+		assignment:      config.Assignment,
+		adopt:           config.Adopt,
+
+		scope:      config.scope(),
+		prefixObjs: map[string]*netboxPrefix{},
+		usage:      map[string]*v1alpha1.PrefixUsage{},
 	}
 
 	if config.Debug {
@@ -93,19 +288,202 @@ func NewNetboxDriver(config *NetboxDriverConfig) (nd *NetboxDriver, err error) {
 	return
 }
 
-func (d *NetboxDriver) getAddresses() ([]*models.IPAddress, error) {
-	response, err := d.client.Ipam.IpamIPAddressesList(
-		ipam.NewIpamIPAddressesListParams().
-			WithParent(&d.prefix), nil)
-	if err != nil {
+// getPrefix find the only netbox prefix matching cidr and the scope
+func (d *NetboxDriver) getPrefix(cidr string) (*netboxPrefix, error) {
+	if prefix, ok := d.prefixObjs[cidr]; ok {
+		return prefix, nil
+	}
+
+	filter := map[string]string{"prefix": cidr}
+	for name, value := range d.scope {
+		filter[name] = value
+	}
+	prefixes := []*netboxPrefix{}
+	if err := d.list("/ipam/prefixes/", filter, &prefixes); err != nil {
+		d.logger.Println(err)
+		return nil, err
+	}
+
+	if len(prefixes) != 1 {
+		err := fmt.Errorf("cannot find or decide prefix %s with filter %v: %d found",
+			cidr, filter, len(prefixes))
 		d.logger.Println(err)
 		return nil, err
 	}
-	return response.Payload.Results, nil
+	d.prefixObjs[cidr] = prefixes[0]
+	return prefixes[0], nil
+}
+
+// getAddresses list the addresses of every prefix, and count the usage of
+// each prefix on the way
+func (d *NetboxDriver) getAddresses() ([]*netboxAddress, error) {
+	all := []*netboxAddress{}
+	for _, cidr := range d.prefixes {
+		prefix, err := d.getPrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		// only addresses in the vrf of prefix, netbox take "null" as global
+		filter := map[string]string{"parent": cidr, "vrf_id": "null"}
+		if prefix.VRF != nil {
+			filter["vrf_id"] = fmt.Sprint(prefix.VRF.ID)
+		}
+
+		list := []*netboxAddress{}
+		if err := d.list("/ipam/ip-addresses/", filter, &list); err != nil {
+			d.logger.Println(err)
+			return nil, err
+		}
+		d.usage[cidr] = &v1alpha1.PrefixUsage{
+			Prefix:   cidr,
+			Capacity: prefixCapacity(cidr),
+			Used:     int64(len(list)),
+		}
+		all = append(all, list...)
+	}
+	return all, nil
+}
+
+// prefixCapacity count the usable addresses of cidr. Network and broadcast
+// addresses of ipv4 prefixes shorter than /31 are excluded.
+func prefixCapacity(cidr string) int64 {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones >= 63 {
+		return math.MaxInt64
+	}
+	capacity := int64(1) << uint(bits-ones)
+	if bits == 32 && bits-ones > 1 {
+		capacity -= 2
+	}
+	return capacity
+}
+
+// containsAddress check whether ip is in one of the prefixes, and return it
+func (d *NetboxDriver) containsAddress(ip net.IP) (string, bool) {
+	for _, cidr := range d.prefixes {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil && ipnet.Contains(ip) {
+			return cidr, true
+		}
+	}
+	return "", false
+}
+
+// Usage impl UsageReporter. It reports what the last GetAddresses saw.
+func (d *NetboxDriver) Usage() (ret []v1alpha1.PrefixUsage) {
+	for _, cidr := range d.prefixes {
+		if usage, ok := d.usage[cidr]; ok {
+			ret = append(ret, *usage)
+		}
+	}
+	return
 }
 
 func (d *NetboxDriver) poolIDTag() string {
-	return fmt.Sprintf("k8s-pool-%s", d.poolID)
+	return netboxPoolTagPrefix + d.poolID
+}
+
+// belongsToPool check whether ipa is a member of this pool
+func (d *NetboxDriver) belongsToPool(ipa *NetboxIPAddress) bool {
+	if d.useStatus {
+		return ipa.customField(netboxFieldPool) == d.poolID
+	}
+	return ipa.hasTag(d.poolIDTag())
+}
+
+// ownedByPool check whether ipa is a member of any pool
+func (d *NetboxDriver) ownedByPool(ipa *NetboxIPAddress) bool {
+	if ipa.customField(netboxFieldPool) != "" {
+		return true
+	}
+	for tag := range ipa.tagset {
+		if strings.HasPrefix(tag, netboxPoolTagPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// foreignHolder tell who holds ipa outside k8s, by a status k8s never
+// sets, an active status without pod in status mode, or an interface while
+// not allocated in tags mode. Adopted addresses are held by the workload
+// moved onto k8s, not a foreign one.
+func (d *NetboxDriver) foreignHolder(ipa *NetboxIPAddress) string {
+	if ipa.hasTag(Adopted) {
+		return ""
+	}
+	status := ipa.status()
+	switch {
+	case status != "" && status != netboxStatusActive && status != netboxStatusReserved:
+		return "status " + status
+	case d.useStatus && status == netboxStatusActive && ipa.customField(netboxFieldPod) == "":
+		return strings.TrimSpace("status active " + ipa.description)
+	case !d.useStatus && !ipa.hasTag(Allocated) && ipa.origin.assignedInterface() != 0:
+		return fmt.Sprintf("interface %d", ipa.origin.assignedInterface())
+	}
+	return ""
+}
+
+// adoptable check whether ipa matches the adopt selector and is free to adopt
+func (d *NetboxDriver) adoptable(ipa *NetboxIPAddress) bool {
+	if d.adopt == nil || d.ownedByPool(ipa) {
+		return false
+	}
+	for _, tag := range d.adopt.Tags {
+		if !ipa.hasTag(tag) {
+			return false
+		}
+	}
+	status := ipa.origin.Status
+	return d.adopt.Status == "" || status != nil && status.Value == d.adopt.Status
+}
+
+// adoptAddress claim ipa into the pool and tag it Adopted
+func (d *NetboxDriver) adoptAddress(ipa *NetboxIPAddress) (err error) {
+	// tags are built from netbox, the Allocated mark may come from status
+	tags := append([]string{Adopted}, ipa.origin.Tags...)
+	fields := map[string]interface{}{}
+	if d.useStatus {
+		fields["custom_fields"] = map[string]interface{}{netboxFieldPool: d.poolID}
+	} else {
+		tags = append(tags, d.poolIDTag())
+	}
+	if fields["tags"], err = d.tagsValue(tags); err != nil {
+		return
+	}
+	if err = d.patchAddress(ipa.origin.ID, fields); err != nil {
+		return
+	}
+
+	ipa.addTag(Adopted)
+	if d.useStatus {
+		if ipa.customFields == nil {
+			ipa.customFields = map[string]interface{}{}
+		}
+		ipa.customFields[netboxFieldPool] = d.poolID
+	} else {
+		ipa.addTag(d.poolIDTag())
+	}
+	d.logger.Printf("Address %s adopted.", ipa.String())
+	return
+}
+
+// patchAddress partially update the address with id by fields. Unlike
+// IpamIPAddressesPartialUpdate, only the given fields are sent, so the other
+// fields of address are left untouched.
+func (d *NetboxDriver) patchAddress(id int64, fields map[string]interface{}) error {
+	_, err := d.do(&netboxRequest{
+		method:     "PATCH",
+		path:       "/ipam/ip-addresses/{id}/",
+		pathParams: map[string]string{"id": fmt.Sprint(id)},
+		body:       fields,
+	}, nil)
+	d.logger.Printf("Netbox patch ipaddress %d with %v -- err: %v", id, fields, err)
+	return err
 }
 
 // GetAddresses get ip in netbox which allocated by k8s (has tag "k8s")
@@ -121,18 +499,39 @@ func (d *NetboxDriver) GetAddresses() (ret []IpamAddress, err error) {
 		for _, tag := range modelAddr.Tags {
 			tagset[tag] = struct{}{}
 		}
-		netip, _, err := net.ParseCIDR(*modelAddr.Address)
+		netip, _, err := net.ParseCIDR(modelAddr.Address)
 		if err != nil {
 			d.logger.Println(err)
 			return nil, err
 		}
 		ipa := &NetboxIPAddress{
-			tagset: tagset,
-			origin: modelAddr,
-			IP:     netip,
+			tagset:       tagset,
+			origin:       modelAddr,
+			IP:           netip,
+			description:  modelAddr.Description,
+			customFields: modelAddr.CustomFields,
 		}
 
-		if ipa.hasTag(d.poolIDTag()) {
+		if d.useStatus {
+			// the allocation state comes from status, not from tag
+			delete(ipa.tagset, Allocated)
+			if modelAddr.Status != nil &&
+				modelAddr.Status.Value == netboxStatusActive {
+				ipa.addTag(Allocated)
+			}
+		}
+
+		if d.adoptable(ipa) {
+			if err := d.adoptAddress(ipa); err != nil {
+				return nil, err
+			}
+		}
+
+		if d.belongsToPool(ipa) {
+			ipa.foreignHolder = d.foreignHolder(ipa)
+			if cidr, ok := d.containsAddress(netip); ok {
+				d.usage[cidr].Pool++
+			}
 			ret = append(ret, ipa)
 		}
 	}
@@ -140,8 +539,24 @@ func (d *NetboxDriver) GetAddresses() (ret []IpamAddress, err error) {
 	return
 }
 
-// MarkAddressAllocated add "k8s-allocated" tag of netbox ipaddress resource
-func (d *NetboxDriver) MarkAddressAllocated(addr IpamAddress, des string) (err error) {
+// dnsName render the dns name template with alct, or return "" if no template
+func (d *NetboxDriver) dnsName(alct *v1alpha1.IPAllocation) string {
+	if d.dnsNameTemplate == "" {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{{pod}}", alct.PodName,
+		"{{namespace}}", alct.PodNamespace,
+		"{{pool}}", d.poolID,
+	).Replace(d.dnsNameTemplate)
+}
+
+// MarkAddressAllocated add "k8s-allocated" tag of netbox ipaddress resource,
+// or set its status to active if UseStatus is configured. The description
+// and dns name are kept up to date with alct on every call. If Assignment is
+// configured the address is assigned to the interface of pod too, and the
+// interface of the pod it was assigned to before is removed.
+func (d *NetboxDriver) MarkAddressAllocated(addr IpamAddress, alct *v1alpha1.IPAllocation) (err error) {
 
 	netboxAddr, ok := addr.(*NetboxIPAddress)
 	if !ok {
@@ -150,41 +565,75 @@ func (d *NetboxDriver) MarkAddressAllocated(addr IpamAddress, des string) (err e
 		return
 	}
 
-	if netboxAddr.hasTag(Allocated) {
+	des := alct.PodNamespace + "/" + alct.PodName
+	dnsName := d.dnsName(alct)
+	if netboxAddr.hasTag(Allocated) &&
+		netboxAddr.description == des &&
+		(d.dnsNameTemplate == "" || netboxAddr.origin.DNSName == dnsName) &&
+		(d.assignment == nil || netboxAddr.origin.assignedInterface() != 0) &&
+		(!d.useStatus || netboxAddr.customField(netboxFieldContainerID) == alct.ContainerID) {
 		return nil
 	}
 
-	_, pool, _ := net.ParseCIDR(d.prefix)
-	if !pool.Contains(netboxAddr.IP) {
-		err = fmt.Errorf("IPAddress %s is not in range %s",
-			netboxAddr.IP, d.prefix)
+	if _, ok := d.containsAddress(netboxAddr.IP); !ok {
+		err = fmt.Errorf("IPAddress %s is not in range %v",
+			netboxAddr.IP, d.prefixes)
 		d.logger.Println(err)
 		return
 	}
 
-	response, err := d.client.Ipam.IpamIPAddressesPartialUpdate(
-		ipam.NewIpamIPAddressesPartialUpdateParams().
-			WithID(netboxAddr.origin.ID).
-			WithData(&models.WritableIPAddress{
-				ID:          netboxAddr.origin.ID,
-				Address:     netboxAddr.origin.Address,
-				Tags:        netboxAddr.addTag(Allocated).tagsArray(),
-				Description: des,
-			}),
-		nil,
-	)
-
-	d.logger.Printf("Netbox update ipaddress with response: %v -- err: %v",
-		response, err)
-
-	if err == nil {
-		d.logger.Printf("Address %s marked allocated.", addr.String())
+	fields := map[string]interface{}{"description": des}
+	if d.dnsNameTemplate != "" {
+		fields["dns_name"] = dnsName
+	}
+	// previous is the interface of the pod the address passes from
+	var ifaceID, previous int64
+	if d.assignment != nil {
+		if ifaceID, err = d.ensureInterface(d.assignment.interfaceName(alct)); err != nil {
+			return
+		}
+		if ifaceID != netboxAddr.origin.assignedInterface() {
+			previous = netboxAddr.origin.assignedInterface()
+			var assign map[string]interface{}
+			if assign, err = d.assignFields(ifaceID); err != nil {
+				return
+			}
+			for key, value := range assign {
+				fields[key] = value
+			}
+		}
+	}
+	if d.useStatus {
+		fields["status"] = netboxStatusActive
+		fields["custom_fields"] = map[string]interface{}{
+			netboxFieldPod:         alct.PodName,
+			netboxFieldNamespace:   alct.PodNamespace,
+			netboxFieldContainerID: alct.ContainerID,
+		}
+	} else if !netboxAddr.hasTag(Allocated) {
+		// tags are only rewritten when they change
+		if fields["tags"], err = d.tagsValue(netboxAddr.addTag(Allocated).tagsArray()); err != nil {
+			return
+		}
 	}
 
+	if err = d.patchAddress(netboxAddr.origin.ID, fields); err != nil {
+		return
+	}
+	d.logger.Printf("Address %s marked allocated.", addr.String())
+	if d.assignment != nil {
+		netboxAddr.origin.AssignedObjectID, netboxAddr.origin.Interface = &ifaceID, nil
+	}
+	if previous != 0 {
+		err = d.deleteInterface(previous)
+	}
 	return
 }
 
-// MarkAddressReleased remove "k8s-allocated" tag of netbox ipaddress resource
+// MarkAddressReleased remove "k8s-allocated" tag of netbox ipaddress resource,
+// or set its status back to reserved if UseStatus is configured. The
+// description and dns name of the pod are cleared as well, and the interface
+// of pod is removed if Assignment is configured.
 // this function is not thread-safe
 func (d *NetboxDriver) MarkAddressReleased(addr IpamAddress) (err error) {
 
@@ -199,23 +648,104 @@ func (d *NetboxDriver) MarkAddressReleased(addr IpamAddress) (err error) {
 		return nil
 	}
 
-	response, err := d.client.Ipam.IpamIPAddressesPartialUpdate(
-		ipam.NewIpamIPAddressesPartialUpdateParams().
-			WithID(netboxAddr.origin.ID).
-			WithData(&models.WritableIPAddress{
-				ID:      netboxAddr.origin.ID,
-				Tags:    netboxAddr.removeTag(Allocated).tagsArray(),
-				Address: netboxAddr.origin.Address,
-			}),
-		nil,
-	)
-	d.logger.Printf("Netbox update ipaddress with response %v -- err: %v",
-		response, err)
+	fields := map[string]interface{}{"description": ""}
+	if d.dnsNameTemplate != "" {
+		fields["dns_name"] = ""
+	}
+	if d.useStatus {
+		fields["status"] = netboxStatusReserved
+		fields["custom_fields"] = map[string]interface{}{
+			netboxFieldPod:         nil,
+			netboxFieldNamespace:   nil,
+			netboxFieldContainerID: nil,
+		}
+	} else if fields["tags"], err = d.tagsValue(netboxAddr.removeTag(Allocated).tagsArray()); err != nil {
+		return
+	}
+	ifaceID := netboxAddr.origin.assignedInterface()
+	if d.assignment != nil && ifaceID != 0 {
+		var assign map[string]interface{}
+		if assign, err = d.assignFields(0); err != nil {
+			return
+		}
+		for key, value := range assign {
+			fields[key] = value
+		}
+	}
+
+	if err = d.patchAddress(netboxAddr.origin.ID, fields); err != nil {
+		return
+	}
+	d.logger.Printf("Address %s marked released.", addr.String())
+	if d.assignment != nil && ifaceID != 0 {
+		err = d.deleteInterface(ifaceID)
+	}
+	return
+}
+
+// Reclaim impl Reclaimer. The hold on addr is undone: its interface is
+// unassigned, and in status mode the active status without pod is set back to
+// reserved. The description and dns name are only cleared if k8s wrote them
+// for a pod. A status k8s never sets is kept, so such an address cannot be
+// reclaimed. The interface itself is not k8s's, so it is left in netbox.
+func (d *NetboxDriver) Reclaim(addr IpamAddress) (err error) {
+	netboxAddr, ok := addr.(*NetboxIPAddress)
+	if !ok {
+		err = fmt.Errorf("cannot assert addr to NetboxIPAddress")
+		d.logger.Println(err)
+		return
+	}
+	status := netboxAddr.status()
+	if status != "" && status != netboxStatusActive && status != netboxStatusReserved {
+		err = fmt.Errorf("%w: address %s has status %s", ErrUnsupported, addr, status)
+		d.logger.Println(err)
+		return
+	}
 
-	if err == nil {
-		d.logger.Printf("Address %s marked released.", addr.String())
+	fields := map[string]interface{}{}
+	written := netboxAddr.hasTag(Allocated)
+	if d.useStatus {
+		written = netboxAddr.customField(netboxFieldPod) != ""
+		fields["status"] = netboxStatusReserved
+		fields["custom_fields"] = map[string]interface{}{
+			netboxFieldPod:         nil,
+			netboxFieldNamespace:   nil,
+			netboxFieldContainerID: nil,
+		}
+	} else if written {
+		if fields["tags"], err = d.tagsValue(netboxAddr.removeTag(Allocated).tagsArray()); err != nil {
+			return
+		}
+	}
+	if written {
+		fields["description"] = ""
+		if d.dnsNameTemplate != "" {
+			fields["dns_name"] = ""
+		}
+	}
+	if netboxAddr.origin.assignedInterface() != 0 {
+		var assign map[string]interface{}
+		if assign, err = d.assignFields(0); err != nil {
+			return
+		}
+		for key, value := range assign {
+			fields[key] = value
+		}
 	}
 
+	if err = d.patchAddress(netboxAddr.origin.ID, fields); err != nil {
+		return
+	}
+	netboxAddr.removeTag(Allocated)
+	if written {
+		netboxAddr.description = ""
+	}
+	if d.useStatus {
+		netboxAddr.origin.Status = &netboxChoice{Value: netboxStatusReserved}
+	}
+	netboxAddr.origin.AssignedObjectID, netboxAddr.origin.Interface = nil, nil
+	netboxAddr.foreignHolder = ""
+	d.logger.Printf("Address %s reclaimed.", addr.String())
 	return
 }
 
@@ -231,51 +761,145 @@ func (d *NetboxDriver) CreateAddress(count int) (err error) {
 		return
 	}
 
-	// get id of the prefix that indecated by poolName(a prefix string)
-	response, err := d.client.Ipam.IpamPrefixesList(
-		ipam.NewIpamPrefixesListParams().WithPrefix(&d.prefix), nil)
-	if err != nil {
+	// fill the prefixes in order, go on with the next one when full
+	for _, cidr := range d.prefixes {
+		if count == 0 {
+			return
+		}
+		var created int
+		if created, err = d.createAddressIn(cidr, count); err != nil {
+			return
+		}
+		count -= created
+	}
+	if count > 0 {
+		err = fmt.Errorf("prefixes %v exhausted, %d addresses not created",
+			d.prefixes, count)
 		d.logger.Println(err)
+	}
+	return
+}
+
+// createAddressIn create at most count addresses in prefix cidr, and return
+// how many are created before it is full
+func (d *NetboxDriver) createAddressIn(cidr string, count int) (created int, err error) {
+	prefix, err := d.getPrefix(cidr)
+	if err != nil {
 		return
 	}
 
-	if *response.Payload.Count != 1 {
-		err = fmt.Errorf("cannot find or decide prefix %s: %v, %v",
-			d.prefix, response.Payload, err)
-		d.logger.Println(err)
+	data, err := d.newAddressData(prefix)
+	if err != nil {
 		return
 	}
+	// try to create all of them in one request first, netbox refuses the
+	// whole batch if the prefix has not enough space for it
+	if count > 1 {
+		batch := make([]map[string]interface{}, count)
+		for idx := range batch {
+			batch[idx] = data
+		}
+		var addrs []*netboxAddress
+		if addrs, err = d.createAvailableIPs(prefix, batch); err != nil {
+			return
+		}
+		if len(addrs) > 0 {
+			d.logger.Printf("%d addresses created in %s", len(addrs), cidr)
+			return len(addrs), nil
+		}
+	}
 
-	// create addresses
-	prefixID := response.Payload.Results[0].ID
-	for ; count > 0; count-- {
-		var createResponse *ipam.IpamPrefixesAvailableIpsCreateOK
-		createResponse, err = d.client.Ipam.IpamPrefixesAvailableIpsCreate(
-			ipam.NewIpamPrefixesAvailableIpsCreateParams().
-				WithID(prefixID).
-				// data should be a WritableIPAddress object. this may be a bug of go-netbox
-				WithData(&models.WritablePrefix{
-					Tags: []string{d.poolIDTag(), Automated},
-				}),
-			nil,
-		)
-		d.logger.Printf("Netbox create ipaddress with response %v err %v",
-			createResponse, err)
-		if err != nil {
-			//TODO: Workaround for https://github.com/netbox-community/netbox/issues/4674
-			if err.(*runtime.APIError).Code == 201 {
-				d.logger.Printf("Netbox returned 201")
-				d.logger.Println(err.(*runtime.APIError).Response)
-				err = nil
-				return
-			}
+	// then one by one, until the prefix is full
+	for ; created < count; created++ {
+		var addrs []*netboxAddress
+		if addrs, err = d.createAvailableIPs(prefix, data); err != nil {
+			return
+		}
+		if len(addrs) == 0 {
+			d.logger.Printf("Prefix %s is full", cidr)
 			return
 		}
-		d.logger.Printf("Address %s created", createResponse.Payload[0].Address)
+		for _, addr := range addrs {
+			d.logger.Printf("Address %s created in %s", addr.Address, cidr)
+		}
 	}
 	return
 }
 
+// newAddressData return the fields of a new address of pool in prefix
+func (d *NetboxDriver) newAddressData(prefix *netboxPrefix) (data map[string]interface{}, err error) {
+	data = map[string]interface{}{}
+	if prefix.VRF != nil {
+		data["vrf"] = prefix.VRF.ID
+	}
+	if prefix.Tenant != nil {
+		data["tenant"] = prefix.Tenant.ID
+	}
+	if d.useStatus {
+		data["tags"], err = d.tagsValue([]string{Automated})
+		data["status"] = netboxStatusReserved
+		data["custom_fields"] = map[string]interface{}{netboxFieldPool: d.poolID}
+	} else {
+		data["tags"], err = d.tagsValue([]string{d.poolIDTag(), Automated})
+	}
+	return
+}
+
+// CreateAddressAt impl SpecificAddressCreator, create ip in the prefix of
+// pool containing it
+func (d *NetboxDriver) CreateAddressAt(ip net.IP) (err error) {
+	cidr, ok := d.containsAddress(ip)
+	if !ok {
+		err = fmt.Errorf("IPAddress %s is not in range %v", ip, d.prefixes)
+		d.logger.Println(err)
+		return
+	}
+	prefix, err := d.getPrefix(cidr)
+	if err != nil {
+		return
+	}
+	data, err := d.newAddressData(prefix)
+	if err != nil {
+		return
+	}
+	_, ipnet, _ := net.ParseCIDR(cidr)
+	ones, _ := ipnet.Mask.Size()
+	data["address"] = fmt.Sprintf("%s/%d", ip, ones)
+
+	if _, err = d.do(&netboxRequest{
+		method: "POST",
+		path:   "/ipam/ip-addresses/",
+		body:   data,
+	}, nil); err == nil {
+		d.logger.Printf("Address %s created in %s", ip, cidr)
+	}
+	return
+}
+
+// createAvailableIPs post body to the available-ips endpoint of prefix. Netbox
+// answer 201 with the created address, or a list of them if body is a list.
+// It answers 204 without body when the prefix has not enough space, then
+// nothing is returned.
+func (d *NetboxDriver) createAvailableIPs(prefix *netboxPrefix, body interface{}) ([]*netboxAddress, error) {
+	raw := json.RawMessage{}
+	if _, err := d.do(&netboxRequest{
+		method:     "POST",
+		path:       "/ipam/prefixes/{id}/available-ips/",
+		pathParams: map[string]string{"id": fmt.Sprint(prefix.ID)},
+		body:       body,
+	}, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	addrs, err := decodeAvailableIPs(raw)
+	if err != nil {
+		d.logger.Println(err)
+	}
+	return addrs, err
+}
+
 // DeleteAddress delete IPAddresses from netbox
 func (d *NetboxDriver) DeleteAddress(addr IpamAddress) (err error) {
 	netboxAddr, ok := addr.(*NetboxIPAddress)
@@ -283,7 +907,7 @@ func (d *NetboxDriver) DeleteAddress(addr IpamAddress) (err error) {
 		return fmt.Errorf("cannot assert addr to NetboxIPAddress")
 	}
 
-	if !netboxAddr.hasTag(Automated) {
+	if !netboxAddr.hasTag(Automated) || netboxAddr.hasTag(Adopted) {
 		err = fmt.Errorf("Cannot delete address which not auto created")
 		d.logger.Println(err)
 		return
@@ -322,3 +946,6 @@ func (d *NetboxDriver) SetLogger(lgr *log.Logger) {
 }
 
 var _ Driver = &NetboxDriver{}
+var _ UsageReporter = &NetboxDriver{}
+var _ SpecificAddressCreator = &NetboxDriver{}
+var _ Reclaimer = &NetboxDriver{}
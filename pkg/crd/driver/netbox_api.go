@@ -0,0 +1,352 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/strfmt"
+)
+
+// netboxPageSize is the page size used when listing objects
+const netboxPageSize = 200
+
+// netboxVersion is the major.minor version of a netbox api
+type netboxVersion struct {
+	major int
+	minor int
+}
+
+// parseNetboxVersion parse version strings like "2.9", "2.10.4" or "v3.0-beta"
+func parseNetboxVersion(raw string) (v netboxVersion, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(raw), "v"), ".", 3)
+	if len(parts) < 2 {
+		err = fmt.Errorf("cannot parse netbox version %q", raw)
+		return
+	}
+	if v.major, err = strconv.Atoi(parts[0]); err != nil {
+		return
+	}
+	minor := strings.FieldsFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if len(minor) == 0 {
+		err = fmt.Errorf("cannot parse netbox version %q", raw)
+		return
+	}
+	v.minor, err = strconv.Atoi(minor[0])
+	return
+}
+
+func (v netboxVersion) atLeast(major, minor int) bool {
+	return v.major > major || (v.major == major && v.minor >= minor)
+}
+
+// nestedTags report whether tags are nested objects (netbox 2.9+) rather than
+// plain strings
+func (v netboxVersion) nestedTags() bool {
+	return v.atLeast(2, 9)
+}
+
+func (v netboxVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// netboxTags decode tags of both netbox < 2.9 (["a", "b"]) and netbox 2.9+
+// ([{"name": "a", "slug": "a"}, ...]). The slug is used for nested tags.
+type netboxTags []string
+
+// UnmarshalJSON ...
+func (t *netboxTags) UnmarshalJSON(data []byte) error {
+	plain := []string{}
+	if err := json.Unmarshal(data, &plain); err == nil {
+		*t = plain
+		return nil
+	}
+	nested := []struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	}{}
+	if err := json.Unmarshal(data, &nested); err != nil {
+		return err
+	}
+	*t = netboxTags{}
+	for _, tag := range nested {
+		if tag.Slug != "" {
+			*t = append(*t, tag.Slug)
+		} else {
+			*t = append(*t, tag.Name)
+		}
+	}
+	return nil
+}
+
+// netboxChoice is a choice field like status, e.g. {"value": "active", ...}
+type netboxChoice struct {
+	Value string `json:"value"`
+	Label string `json:"label"`
+}
+
+// netboxAddress is the part of netbox ip address object used by driver
+type netboxAddress struct {
+	ID           int64                  `json:"id"`
+	Address      string                 `json:"address"`
+	Description  string                 `json:"description"`
+	DNSName      string                 `json:"dns_name"`
+	Status       *netboxChoice          `json:"status"`
+	Tags         netboxTags             `json:"tags"`
+	CustomFields map[string]interface{} `json:"custom_fields"`
+
+	// AssignedObjectID is the interface assigned to since netbox 2.9,
+	// Interface before it
+	AssignedObjectID *int64     `json:"assigned_object_id"`
+	Interface        *netboxRef `json:"interface"`
+}
+
+// netboxRef is a nested object referenced by another, e.g. the vrf of prefix
+type netboxRef struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// netboxPrefix is the part of netbox prefix object used by driver
+type netboxPrefix struct {
+	ID     int64      `json:"id"`
+	Prefix string     `json:"prefix"`
+	VRF    *netboxRef `json:"vrf"`
+	Tenant *netboxRef `json:"tenant"`
+}
+
+// netboxList is a page of a netbox list endpoint
+type netboxList struct {
+	Count   int             `json:"count"`
+	Next    *string         `json:"next"`
+	Results json.RawMessage `json:"results"`
+}
+
+// netboxRequest describe a call to the netbox rest api
+type netboxRequest struct {
+	method     string
+	path       string
+	pathParams map[string]string
+	query      map[string]string
+	body       interface{}
+}
+
+// do submit req with the transport of go-netbox client and decode the response
+// body into out, if out is not nil. The response header is returned as well.
+func (d *NetboxDriver) do(req *netboxRequest, out interface{}) (header http.Header, err error) {
+	header = http.Header{}
+	_, err = d.client.Transport.Submit(&runtime.ClientOperation{
+		ID:                 req.method + " " + req.path,
+		Method:             req.method,
+		PathPattern:        req.path,
+		ProducesMediaTypes: []string{"application/json"},
+		ConsumesMediaTypes: []string{"application/json"},
+		Schemes:            []string{"http"},
+		Params: runtime.ClientRequestWriterFunc(
+			func(r runtime.ClientRequest, _ strfmt.Registry) error {
+				for name, value := range req.pathParams {
+					if err := r.SetPathParam(name, value); err != nil {
+						return err
+					}
+				}
+				for name, value := range req.query {
+					if err := r.SetQueryParam(name, value); err != nil {
+						return err
+					}
+				}
+				if req.body != nil {
+					return r.SetBodyParam(req.body)
+				}
+				return nil
+			}),
+		Reader: runtime.ClientResponseReaderFunc(
+			func(response runtime.ClientResponse, consumer runtime.Consumer) (interface{}, error) {
+				header.Set("API-Version", response.GetHeader("API-Version"))
+				if response.Code()/100 != 2 {
+					return nil, runtime.NewAPIError(
+						"unexpected response", response.Message(), response.Code())
+				}
+				if out != nil && response.Code() != http.StatusNoContent {
+					if err := consumer.Consume(response.Body(), out); err != nil {
+						return nil, err
+					}
+				}
+				return nil, nil
+			}),
+	})
+	if err != nil {
+		d.logger.Printf("Netbox %s %s failed: %v", req.method, req.path, err)
+	}
+	return
+}
+
+// list fetch every object of a list endpoint page by page, and append the
+// decoded results to out, which must be a pointer to slice
+func (d *NetboxDriver) list(path string, query map[string]string, out interface{}) error {
+	offset := 0
+	for {
+		pageQuery := map[string]string{
+			"limit":  strconv.Itoa(netboxPageSize),
+			"offset": strconv.Itoa(offset),
+		}
+		for name, value := range query {
+			pageQuery[name] = value
+		}
+		page := &netboxList{}
+		if _, err := d.do(&netboxRequest{
+			method: "GET",
+			path:   path,
+			query:  pageQuery,
+		}, page); err != nil {
+			return err
+		}
+
+		results := []json.RawMessage{}
+		if err := json.Unmarshal(page.Results, &results); err != nil {
+			return err
+		}
+		if err := appendDecoded(out, results); err != nil {
+			return err
+		}
+
+		offset += len(results)
+		if page.Next == nil || len(results) == 0 || offset >= page.Count {
+			return nil
+		}
+	}
+}
+
+// appendDecoded decode each raw message and append it to the slice out points to
+func appendDecoded(out interface{}, results []json.RawMessage) error {
+	switch list := out.(type) {
+	case *[]*netboxAddress:
+		for _, raw := range results {
+			item := &netboxAddress{}
+			if err := json.Unmarshal(raw, item); err != nil {
+				return err
+			}
+			*list = append(*list, item)
+		}
+	case *[]*netboxPrefix:
+		for _, raw := range results {
+			item := &netboxPrefix{}
+			if err := json.Unmarshal(raw, item); err != nil {
+				return err
+			}
+			*list = append(*list, item)
+		}
+	case *[]*netboxRef:
+		for _, raw := range results {
+			item := &netboxRef{}
+			if err := json.Unmarshal(raw, item); err != nil {
+				return err
+			}
+			*list = append(*list, item)
+		}
+	default:
+		return fmt.Errorf("cannot decode netbox list into %T", out)
+	}
+	return nil
+}
+
+// getVersion detect the netbox version once per driver. The status endpoint
+// (netbox 2.10+) report it in body; older ones only set the API-Version
+// header, which is sent on every api response, including a 404.
+func (d *NetboxDriver) getVersion() (netboxVersion, error) {
+	if d.version != nil {
+		return *d.version, nil
+	}
+
+	status := map[string]interface{}{}
+	header, err := d.do(&netboxRequest{method: "GET", path: "/status/"}, &status)
+	raw, _ := status["netbox-version"].(string)
+	if raw == "" {
+		raw = header.Get("API-Version")
+	}
+	if raw == "" {
+		if err == nil {
+			err = fmt.Errorf("netbox version not reported by api")
+		}
+		d.logger.Println(err)
+		return netboxVersion{}, err
+	}
+
+	version, err := parseNetboxVersion(raw)
+	if err != nil {
+		d.logger.Println(err)
+		return netboxVersion{}, err
+	}
+	d.logger.Printf("Detected netbox version %s", version)
+	d.version = &version
+	return version, nil
+}
+
+// tagsValue return tags in the format the netbox api expects. For netbox
+// 2.9+, the tags are created first if they do not exist yet.
+func (d *NetboxDriver) tagsValue(tags []string) (interface{}, error) {
+	version, err := d.getVersion()
+	if err != nil {
+		return nil, err
+	}
+	if !version.nestedTags() {
+		return tags, nil
+	}
+
+	nested := []map[string]string{}
+	for _, tag := range tags {
+		if err := d.ensureTag(tag); err != nil {
+			return nil, err
+		}
+		nested = append(nested, map[string]string{"slug": tag})
+	}
+	return nested, nil
+}
+
+// ensureTag create the tag object with slug and name tag if it is missing
+func (d *NetboxDriver) ensureTag(tag string) error {
+	if _, ok := d.knownTags[tag]; ok {
+		return nil
+	}
+
+	page := &netboxList{}
+	if _, err := d.do(&netboxRequest{
+		method: "GET",
+		path:   "/extras/tags/",
+		query:  map[string]string{"slug": tag},
+	}, page); err != nil {
+		return err
+	}
+	if page.Count == 0 {
+		if _, err := d.do(&netboxRequest{
+			method: "POST",
+			path:   "/extras/tags/",
+			body:   map[string]string{"name": tag, "slug": tag},
+		}, nil); err != nil {
+			return err
+		}
+		d.logger.Printf("Tag %s created", tag)
+	}
+
+	if d.knownTags == nil {
+		d.knownTags = map[string]struct{}{}
+	}
+	d.knownTags[tag] = struct{}{}
+	return nil
+}
+
+// decodeAvailableIPs decode the response of available-ips creation, which is
+// a single object when one address is requested and a list otherwise
+func decodeAvailableIPs(raw json.RawMessage) ([]*netboxAddress, error) {
+	list := []*netboxAddress{}
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+	single := &netboxAddress{}
+	if err := json.Unmarshal(raw, single); err != nil {
+		return nil, err
+	}
+	return []*netboxAddress{single}, nil
+}
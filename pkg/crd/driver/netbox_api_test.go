@@ -0,0 +1,658 @@
+package driver
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+func TestParseNetboxVersion(t *testing.T) {
+	testCases := []struct {
+		raw    string
+		major  int
+		minor  int
+		nested bool
+	}{
+		{"2.8", 2, 8, false},
+		{"2.9", 2, 9, true},
+		{"2.10.4", 2, 10, true},
+		{"v3.0-beta1", 3, 0, true},
+	}
+
+	for _, tc := range testCases {
+		v, err := parseNetboxVersion(tc.raw)
+		if err != nil {
+			t.Errorf("%s: %v", tc.raw, err)
+			continue
+		}
+		if v.major != tc.major || v.minor != tc.minor || v.nestedTags() != tc.nested {
+			t.Errorf("%s: unexpected version %v", tc.raw, v)
+		}
+	}
+
+	if _, err := parseNetboxVersion("latest"); err == nil {
+		t.Errorf("invalid version should fail")
+	}
+}
+
+func TestNetboxTagsUnmarshal(t *testing.T) {
+	for _, raw := range []string{
+		`["k8s-automated", "k8s-pool-a"]`,
+		`[{"id": 1, "name": "k8s-automated", "slug": "k8s-automated"},
+		  {"id": 2, "name": "K8s Pool A", "slug": "k8s-pool-a"}]`,
+	} {
+		tags := netboxTags{}
+		if err := json.Unmarshal([]byte(raw), &tags); err != nil {
+			t.Fatal(err)
+		}
+		if len(tags) != 2 || tags[0] != Automated || tags[1] != "k8s-pool-a" {
+			t.Errorf("unexpected tags %v from %s", tags, raw)
+		}
+	}
+}
+
+func TestDecodeAvailableIPs(t *testing.T) {
+	for _, raw := range []string{
+		`{"id": 1, "address": "10.0.0.1/24"}`,
+		`[{"id": 1, "address": "10.0.0.1/24"}]`,
+	} {
+		addrs, err := decodeAvailableIPs(json.RawMessage(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0].ID != 1 || addrs[0].Address != "10.0.0.1/24" {
+			t.Errorf("unexpected addresses %v from %s", addrs, raw)
+		}
+	}
+}
+
+// TestNetboxNestedTags run the driver against a fake netbox 2.9 api
+func TestNetboxNestedTags(t *testing.T) {
+	f := newFakeNetbox(t)
+	defer f.Close()
+	f.version = "2.9"
+	f.prefixes["10.0.0.0/24"] = `{"id": 7, "prefix": "10.0.0.0/24", "vrf": {"id": 3, "name": "blue"}}`
+	f.addresses["10.0.0.0/24"] = `[
+		{"id": 1, "address": "10.0.0.1/24", "tags": [
+			{"name": "k8s-automated", "slug": "k8s-automated"},
+			{"name": "k8s-pool-a", "slug": "k8s-pool-a"}]},
+		{"id": 2, "address": "10.0.0.2/24", "tags": [
+			{"name": "other", "slug": "other"}]}]`
+	f.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		switch r.URL.Path {
+		case "/api/ipam/prefixes/":
+			if r.URL.Query().Get("vrf") != "65000:1" {
+				t.Errorf("prefix not scoped by vrf: %s", r.URL)
+			}
+		case "/api/ipam/ip-addresses/":
+			if r.URL.Query().Get("vrf_id") != "3" {
+				t.Errorf("addresses not scoped by vrf of prefix: %s", r.URL)
+			}
+		}
+		return false
+	}
+
+	d, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:   f.host(),
+		Prefix: "10.0.0.0/24",
+		VRF:    "65000:1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetPoolID("a")
+
+	addrs, err := d.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || !addrs[0].MarkedWith(Automated) {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+
+	if err := d.MarkAddressReleased(addrs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.patched) != 0 {
+		t.Errorf("address not allocated should not be patched: %v", f.patched)
+	}
+
+	addrs[0].(*NetboxIPAddress).addTag(Allocated)
+	if err := d.MarkAddressReleased(addrs[0]); err != nil {
+		t.Fatal(err)
+	}
+	patched := f.lastPatch("/api/ipam/ip-addresses/1/")
+	tags, _ := patched["tags"].([]interface{})
+	if len(tags) != 2 {
+		t.Fatalf("unexpected patch %v", patched)
+	}
+	for _, tag := range tags {
+		if _, ok := tag.(map[string]interface{})["slug"]; !ok {
+			t.Errorf("tag %v is not nested", tag)
+		}
+	}
+}
+
+func TestPrefixCapacity(t *testing.T) {
+	testCases := []struct {
+		cidr     string
+		capacity int64
+	}{
+		{"10.0.0.0/24", 254},
+		{"10.0.0.0/31", 2},
+		{"10.0.0.1/32", 1},
+		{"fd00::/120", 256},
+	}
+
+	for _, tc := range testCases {
+		if capacity := prefixCapacity(tc.cidr); capacity != tc.capacity {
+			t.Errorf("%s: capacity %d, expected %d", tc.cidr, capacity, tc.capacity)
+		}
+	}
+}
+
+// TestNetboxPrefixOverflow run the driver against a fake netbox whose first
+// prefix is full
+func TestNetboxPrefixOverflow(t *testing.T) {
+	f := newFakeNetbox(t)
+	defer f.Close()
+	f.prefixes["10.0.0.0/30"] = `{"id": 1, "prefix": "10.0.0.0/30"}`
+	f.prefixes["10.0.1.0/24"] = `{"id": 2, "prefix": "10.0.1.0/24"}`
+	f.addresses["10.0.0.0/30"] = `[
+		{"id": 1, "address": "10.0.0.1/30", "tags": ["k8s-pool-a"]},
+		{"id": 2, "address": "10.0.0.2/30", "tags": []}]`
+	f.addresses["10.0.1.0/24"] = `[
+		{"id": 9, "address": "10.0.1.1/24", "tags": ["k8s-pool-a"]}]`
+	created := map[string]int{}
+	f.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		switch r.URL.Path {
+		case "/api/ipam/prefixes/1/available-ips/":
+			w.WriteHeader(http.StatusNoContent)
+		case "/api/ipam/prefixes/2/available-ips/":
+			batch := []interface{}{}
+			if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+				t.Errorf("addresses not created in batch: %v", err)
+			}
+			created["10.0.1.0/24"] += len(batch)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(make([]map[string]string, len(batch)))
+		default:
+			return false
+		}
+		return true
+	}
+
+	d, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:     f.host(),
+		Prefixes: []string{"10.0.0.0/30", "10.0.1.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetPoolID("a")
+
+	if err := d.CreateAddress(2); err != nil {
+		t.Fatal(err)
+	}
+	if created["10.0.1.0/24"] != 2 {
+		t.Errorf("addresses not created in second prefix: %v", created)
+	}
+
+	addrs, err := d.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+	usage := d.Usage()
+	if len(usage) != 2 ||
+		usage[0].Capacity != 2 || usage[0].Used != 2 || usage[0].Pool != 1 ||
+		usage[1].Capacity != 254 || usage[1].Used != 1 || usage[1].Pool != 1 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+}
+
+func TestNetboxTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", "2.10")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"netbox-version": "2.10.4"}`))
+	}))
+	defer server.Close()
+
+	caPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})
+	config := &NetboxDriverConfig{
+		Host:   strings.TrimPrefix(server.URL, "https://"),
+		Prefix: "10.0.0.0/24",
+		Scheme: "https",
+		CARef:  &NetboxKeyRef{Kind: "ConfigMap", Name: "netbox-ca", Key: "ca.crt"},
+	}
+	if _, err := NewNetboxDriver(config); err == nil {
+		t.Errorf("unresolved ca ref should fail")
+	}
+
+	if err := config.ResolveRefs(func(ref *NetboxKeyRef) ([]byte, error) {
+		if ref.Name != "netbox-ca" || ref.Key != "ca.crt" {
+			t.Errorf("unexpected ref %v", ref)
+		}
+		return caPEM, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewNetboxDriver(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := d.getVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.String() != "2.10" {
+		t.Errorf("unexpected version %s", version)
+	}
+}
+
+func TestNetboxClientCache(t *testing.T) {
+	config := &NetboxDriverConfig{Host: "netbox.example.com", Prefix: "10.0.0.0/24", APIKey: "a"}
+	first, err := getNetboxClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := getNetboxClient(&NetboxDriverConfig{Host: "netbox.example.com", APIKey: "a"}); again != first {
+		t.Errorf("expect the client of same config reused")
+	}
+	if other, _ := getNetboxClient(&NetboxDriverConfig{Host: "netbox.example.com", APIKey: "b"}); other == first {
+		t.Errorf("expect a new client for another api key")
+	}
+
+	// an idle client is dropped
+	key, _ := config.clientKey()
+	netboxClientsLock.Lock()
+	netboxClients[key].lastUsed = time.Now().Add(-clientIdleTimeout - time.Second)
+	netboxClientsLock.Unlock()
+	if again, _ := getNetboxClient(config); again == first {
+		t.Errorf("expect the idle client rebuilt")
+	}
+}
+
+func TestNetboxDNSName(t *testing.T) {
+	f := newFakeNetbox(t)
+	defer f.Close()
+
+	d, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:            f.host(),
+		Prefix:          "10.0.0.0/24",
+		DNSNameTemplate: "{{pod}}.{{namespace}}.k8s.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the address is still allocated, but to a previous pod
+	addr := &NetboxIPAddress{
+		IP:          net.ParseIP("10.0.0.1"),
+		tagset:      map[string]interface{}{Allocated: struct{}{}},
+		origin:      &netboxAddress{ID: 1, DNSName: "old.default.k8s.example.com"},
+		description: "default/old",
+	}
+	alct := &v1alpha1.IPAllocation{PodName: "web-0", PodNamespace: "prod"}
+	if err := d.MarkAddressAllocated(addr, alct); err != nil {
+		t.Fatal(err)
+	}
+	patched := f.lastPatch("/api/ipam/ip-addresses/1/")
+	if patched["dns_name"] != "web-0.prod.k8s.example.com" ||
+		patched["description"] != "prod/web-0" {
+		t.Errorf("unexpected patch %v", patched)
+	}
+	if _, ok := patched["tags"]; ok {
+		t.Errorf("tags should not be rewritten: %v", patched)
+	}
+
+	if err := d.MarkAddressReleased(addr); err != nil {
+		t.Fatal(err)
+	}
+	patched = f.lastPatch("/api/ipam/ip-addresses/1/")
+	if patched["dns_name"] != "" || patched["description"] != "" {
+		t.Errorf("dns name and description not cleared: %v", patched)
+	}
+}
+
+func TestNetboxAssignment(t *testing.T) {
+	f := newFakeNetbox(t)
+	defer f.Close()
+	f.version, f.status = "2.9", "2.9.3"
+	created := 0
+	f.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.URL.Path == "/api/virtualization/virtual-machines/":
+			if r.URL.Query().Get("name") != "k8s" || r.URL.Query().Get("cluster") != "prod" {
+				t.Errorf("unexpected vm query %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"count": 1, "results": [{"id": 5, "name": "k8s"}]}`))
+		case r.URL.Path == "/api/virtualization/interfaces/" && r.Method == "GET":
+			if r.URL.Query().Get("virtual_machine_id") != "5" {
+				t.Errorf("unexpected interface query %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"count": 0, "results": []}`))
+		case r.URL.Path == "/api/virtualization/interfaces/" && r.Method == "POST":
+			body := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["name"] != "prod/web-0" || body["virtual_machine"] != float64(5) {
+				t.Errorf("unexpected interface %v", body)
+			}
+			created++
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": 7, "name": "prod/web-0"}`))
+		default:
+			return false
+		}
+		return true
+	}
+
+	d, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:       f.host(),
+		Prefix:     "10.0.0.0/24",
+		Assignment: &NetboxAssignment{VirtualMachine: "k8s", Cluster: "prod"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := &NetboxIPAddress{
+		IP:     net.ParseIP("10.0.0.1"),
+		tagset: map[string]interface{}{},
+		origin: &netboxAddress{ID: 1},
+	}
+	alct := &v1alpha1.IPAllocation{PodName: "web-0", PodNamespace: "prod"}
+	if err := d.MarkAddressAllocated(addr, alct); err != nil {
+		t.Fatal(err)
+	}
+	patched := f.lastPatch("/api/ipam/ip-addresses/1/")
+	if created != 1 || patched["assigned_object_type"] != "virtualization.vminterface" ||
+		patched["assigned_object_id"] != float64(7) {
+		t.Errorf("address not assigned to interface: %v", patched)
+	}
+
+	ifaceID := int64(7)
+	addr.origin.AssignedObjectID = &ifaceID
+	if err := d.MarkAddressReleased(addr); err != nil {
+		t.Fatal(err)
+	}
+	patched = f.lastPatch("/api/ipam/ip-addresses/1/")
+	if v, ok := patched["assigned_object_id"]; !ok || v != nil {
+		t.Errorf("address not unassigned: %v", patched)
+	}
+	if len(f.deleted) != 1 || f.deleted[0] != "/api/virtualization/interfaces/7/" {
+		t.Errorf("interface not deleted: %v", f.deleted)
+	}
+
+	// the address passes to another pod between syncs, the interface of the
+	// previous pod goes with it
+	oldIfaceID := int64(6)
+	addr = &NetboxIPAddress{
+		IP:          net.ParseIP("10.0.0.2"),
+		tagset:      map[string]interface{}{Allocated: struct{}{}},
+		origin:      &netboxAddress{ID: 2, AssignedObjectID: &oldIfaceID},
+		description: "prod/old-0",
+	}
+	if err := d.MarkAddressAllocated(addr, alct); err != nil {
+		t.Fatal(err)
+	}
+	if patched := f.lastPatch("/api/ipam/ip-addresses/2/"); patched["assigned_object_id"] != float64(7) {
+		t.Errorf("address not reassigned: %v", patched)
+	}
+	if len(f.deleted) != 2 || f.deleted[1] != "/api/virtualization/interfaces/6/" {
+		t.Errorf("interface of previous pod not deleted: %v", f.deleted)
+	}
+
+	if _, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:       "localhost",
+		Prefix:     "10.0.0.0/24",
+		Assignment: &NetboxAssignment{},
+	}); err == nil {
+		t.Errorf("assignment without parent should fail")
+	}
+}
+
+func TestNetboxAdopt(t *testing.T) {
+	f := newFakeNetbox(t)
+	defer f.Close()
+	f.prefixes["10.0.0.0/24"] = `{"id": 7, "prefix": "10.0.0.0/24"}`
+	f.addresses["10.0.0.0/24"] = `[
+		{"id": 1, "address": "10.0.0.1/24", "tags": ["legacy"],
+		 "status": {"value": "active"}},
+		{"id": 2, "address": "10.0.0.2/24", "tags": ["legacy", "k8s-pool-b"],
+		 "status": {"value": "active"}},
+		{"id": 3, "address": "10.0.0.3/24", "tags": ["legacy"],
+		 "status": {"value": "deprecated"}},
+		{"id": 4, "address": "10.0.0.4/24", "tags": [],
+		 "status": {"value": "active"}}]`
+
+	d, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:   f.host(),
+		Prefix: "10.0.0.0/24",
+		Adopt:  &NetboxAdoptSelector{Tags: []string{"legacy"}, Status: "active"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetPoolID("a")
+
+	addrs, err := d.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || !addrs[0].MarkedWith(Adopted) {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+	tags, _ := f.lastPatch("/api/ipam/ip-addresses/1/")["tags"].([]interface{})
+	if len(f.patched) != 1 || len(tags) != 3 {
+		t.Errorf("unexpected patches %v", f.patched)
+	}
+
+	addrs[0].(*NetboxIPAddress).addTag(Automated)
+	if err := d.DeleteAddress(addrs[0]); err == nil {
+		t.Errorf("adopted address should not be deleted")
+	}
+
+	if _, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:   "localhost",
+		Prefix: "10.0.0.0/24",
+		Adopt:  &NetboxAdoptSelector{},
+	}); err == nil {
+		t.Errorf("empty adopt selector should fail")
+	}
+}
+
+func TestNetboxReclaim(t *testing.T) {
+	f := newFakeNetbox(t)
+	defer f.Close()
+	f.prefixes["10.0.0.0/24"] = `{"id": 7, "prefix": "10.0.0.0/24"}`
+	f.addresses["10.0.0.0/24"] = `[
+		{"id": 1, "address": "10.0.0.1/24", "tags": ["k8s-pool-a", "k8s-automated"],
+		 "status": {"value": "active"}, "interface": {"id": 9, "name": "eth0"}},
+		{"id": 2, "address": "10.0.0.2/24",
+		 "tags": ["k8s-pool-a", "k8s-automated", "k8s-allocated"],
+		 "status": {"value": "deprecated"}}]`
+
+	d, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:   f.host(),
+		Prefix: "10.0.0.0/24",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetPoolID("a")
+	spec := &v1alpha1.IPPoolSpec{
+		Addresses: []string{"10.0.0.1", "10.0.0.2"},
+		Allocations: []v1alpha1.IPAllocation{
+			{Address: "10.0.0.2", PodName: "b", PodNamespace: "default"},
+		},
+		DriftPolicy: v1alpha1.DriftPolicyRepair,
+	}
+
+	drifts, err := Sync(d, spec, 0, d.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 2 {
+		t.Fatalf("unexpected drifts %v", drifts)
+	}
+
+	// the interface held address is unassigned and left free, its status
+	// and the fields k8s did not write are kept
+	first := f.patched["/api/ipam/ip-addresses/1/"]
+	if len(first) != 1 {
+		t.Fatalf("10.0.0.1 not reclaimed: %v", first)
+	}
+	if v, ok := first[0]["interface"]; !ok || v != nil {
+		t.Errorf("10.0.0.1 not unassigned: %v", first[0])
+	}
+	for _, field := range []string{"status", "description", "dns_name", "tags"} {
+		if _, ok := first[0][field]; ok {
+			t.Errorf("10.0.0.1 %s should be kept: %v", field, first[0])
+		}
+	}
+
+	// the status k8s never sets is kept, so the address stays foreign
+	if second := f.patched["/api/ipam/ip-addresses/2/"]; len(second) != 0 {
+		t.Errorf("10.0.0.2 should not be touched: %v", second)
+	}
+}
+
+// TestNetboxAdoptSync run a sync repairing drift on a pool of adopted
+// addresses, which are in use by the workload moved onto k8s
+func TestNetboxAdoptSync(t *testing.T) {
+	f := newFakeNetbox(t)
+	defer f.Close()
+	f.prefixes["10.0.0.0/24"] = `{"id": 7, "prefix": "10.0.0.0/24"}`
+	f.addresses["10.0.0.0/24"] = `[
+		{"id": 1, "address": "10.0.0.1/24", "tags": ["legacy"], "description": "db-1",
+		 "dns_name": "db-1.example.com", "status": {"value": "active"},
+		 "interface": {"id": 9, "name": "eth0"}}]`
+
+	d, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:   f.host(),
+		Prefix: "10.0.0.0/24",
+		Adopt:  &NetboxAdoptSelector{Tags: []string{"legacy"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetPoolID("a")
+	minFree := int32(0)
+	spec := &v1alpha1.IPPoolSpec{MinFree: &minFree, DriftPolicy: v1alpha1.DriftPolicyRepair}
+
+	drifts, err := Sync(d, spec, 0, d.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 0 {
+		t.Errorf("adopted address should not drift: %v", drifts)
+	}
+	if len(spec.Addresses) != 1 || spec.Addresses[0] != "10.0.0.1" {
+		t.Errorf("adopted address not in pool: %v", spec.Addresses)
+	}
+	// only the adoption itself is written
+	patches := f.patched["/api/ipam/ip-addresses/1/"]
+	if len(patches) != 1 || len(patches[0]) != 1 || patches[0]["tags"] == nil {
+		t.Errorf("adopted address should only be tagged: %v", patches)
+	}
+}
+
+// TestNetboxStatusMode run a sync against a fake netbox with the state kept
+// in status and custom fields
+func TestNetboxStatusMode(t *testing.T) {
+	f := newFakeNetbox(t)
+	defer f.Close()
+	f.prefixes["10.0.0.0/24"] = `{"id": 7, "prefix": "10.0.0.0/24"}`
+	f.addresses["10.0.0.0/24"] = `[
+		{"id": 1, "address": "10.0.0.1/24", "tags": ["k8s-automated"],
+		 "status": {"value": "reserved"}, "custom_fields": {"k8s_pool": "a"}},
+		{"id": 2, "address": "10.0.0.2/24", "tags": ["k8s-automated"],
+		 "status": {"value": "active"}, "description": "default/old",
+		 "custom_fields": {"k8s_pool": "a", "k8s_pod": "old", "k8s_namespace": "default"}},
+		{"id": 3, "address": "10.0.0.3/24", "tags": ["k8s-automated"],
+		 "status": {"value": "active"}, "description": "printer",
+		 "custom_fields": {"k8s_pool": "a"}},
+		{"id": 4, "address": "10.0.0.4/24", "tags": ["k8s-automated"],
+		 "status": {"value": "reserved"}, "custom_fields": {"k8s_pool": "b"}}]`
+
+	d, err := NewNetboxDriver(&NetboxDriverConfig{
+		Host:      f.host(),
+		Prefix:    "10.0.0.0/24",
+		UseStatus: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetPoolID("a")
+
+	addrs, err := d.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 3 {
+		t.Fatalf("expect the addresses of pool a, got %v", addrs)
+	}
+	if addrs[0].MarkedWith(Allocated) || !addrs[1].MarkedWith(Allocated) {
+		t.Errorf("allocation not taken from status: %v", addrs)
+	}
+
+	minFree, maxFree := int32(0), int32(5)
+	spec := &v1alpha1.IPPoolSpec{
+		Addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		Allocations: []v1alpha1.IPAllocation{
+			{Address: "10.0.0.1", PodName: "web-0", PodNamespace: "prod", ContainerID: "c1"},
+		},
+		MinFree: &minFree,
+		MaxFree: &maxFree,
+	}
+	drifts, err := Sync(d, spec, 0, d.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 1 || drifts[0].Kind != DriftForeign || drifts[0].Address != "10.0.0.3" ||
+		drifts[0].Holder != "status active printer" {
+		t.Errorf("unexpected drifts %v", drifts)
+	}
+
+	// allocated by status and custom fields, tags left alone
+	allocated := f.lastPatch("/api/ipam/ip-addresses/1/")
+	fields, _ := allocated["custom_fields"].(map[string]interface{})
+	if allocated["status"] != "active" || allocated["description"] != "prod/web-0" ||
+		fields["k8s_pod"] != "web-0" || fields["k8s_namespace"] != "prod" ||
+		fields["k8s_container_id"] != "c1" {
+		t.Errorf("10.0.0.1 not allocated: %v", allocated)
+	}
+	if _, ok := allocated["tags"]; ok {
+		t.Errorf("tags should not be rewritten: %v", allocated)
+	}
+
+	// released back to reserved with the pod fields cleared
+	released := f.lastPatch("/api/ipam/ip-addresses/2/")
+	fields, _ = released["custom_fields"].(map[string]interface{})
+	if released["status"] != "reserved" || released["description"] != "" ||
+		fields["k8s_pod"] != nil || len(fields) != 3 {
+		t.Errorf("10.0.0.2 not released: %v", released)
+	}
+	if _, ok := released["tags"]; ok {
+		t.Errorf("tags should not be rewritten: %v", released)
+	}
+
+	// the foreign held address is left alone under Warn
+	if patches := f.patched["/api/ipam/ip-addresses/3/"]; len(patches) != 0 {
+		t.Errorf("10.0.0.3 should not be touched: %v", patches)
+	}
+}
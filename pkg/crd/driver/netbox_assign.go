@@ -0,0 +1,176 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+// defaultInterfaceTemplate name the interface of pod if no template given
+const defaultInterfaceTemplate = "{{namespace}}/{{pod}}"
+
+// NetboxAssignment make the driver create an interface per pod on a virtual
+// machine or device which stands for the cluster, and assign the address of
+// pod to it. The interface is removed when the address is released.
+type NetboxAssignment struct {
+	// VirtualMachine is the name of the virtual machine to create the
+	// interfaces on. Cluster narrow down the lookup of it.
+	VirtualMachine string `json:"virtualMachine"`
+	Cluster        string `json:"cluster"`
+
+	// Device is the name of the device to create the interfaces on, used
+	// instead of a virtual machine
+	Device string `json:"device"`
+
+	// InterfaceTemplate is rendered into the interface name, default to
+	// "{{namespace}}/{{pod}}"
+	InterfaceTemplate string `json:"interfaceTemplate"`
+}
+
+// validate check that exactly one parent is configured
+func (a *NetboxAssignment) validate() error {
+	if (a.VirtualMachine == "") == (a.Device == "") {
+		return fmt.Errorf("assignment needs one of virtualMachine or device")
+	}
+	return nil
+}
+
+// paths return the endpoints of the parent and its interfaces, and the field
+// of interface refering to the parent
+func (a *NetboxAssignment) paths() (parent, iface, parentField string) {
+	if a.Device != "" {
+		return "/dcim/devices/", "/dcim/interfaces/", "device"
+	}
+	return "/virtualization/virtual-machines/", "/virtualization/interfaces/", "virtual_machine"
+}
+
+// interfaceName render the interface template with alct
+func (a *NetboxAssignment) interfaceName(alct *v1alpha1.IPAllocation) string {
+	template := a.InterfaceTemplate
+	if template == "" {
+		template = defaultInterfaceTemplate
+	}
+	return strings.NewReplacer(
+		"{{pod}}", alct.PodName,
+		"{{namespace}}", alct.PodNamespace,
+	).Replace(template)
+}
+
+// getAssignParent find the virtual machine or device of the assignment
+func (d *NetboxDriver) getAssignParent() (*netboxRef, error) {
+	if d.assignParent != nil {
+		return d.assignParent, nil
+	}
+
+	path, _, _ := d.assignment.paths()
+	filter := map[string]string{"name": d.assignment.Device}
+	if d.assignment.Device == "" {
+		filter["name"] = d.assignment.VirtualMachine
+		if d.assignment.Cluster != "" {
+			filter["cluster"] = d.assignment.Cluster
+		}
+	}
+	parents := []*netboxRef{}
+	if err := d.list(path, filter, &parents); err != nil {
+		return nil, err
+	}
+	if len(parents) != 1 {
+		err := fmt.Errorf("cannot find or decide %s with filter %v: %d found",
+			path, filter, len(parents))
+		d.logger.Println(err)
+		return nil, err
+	}
+	d.assignParent = parents[0]
+	return d.assignParent, nil
+}
+
+// ensureInterface get or create the interface named name on the parent
+func (d *NetboxDriver) ensureInterface(name string) (int64, error) {
+	parent, err := d.getAssignParent()
+	if err != nil {
+		return 0, err
+	}
+
+	_, path, parentField := d.assignment.paths()
+	ifaces := []*netboxRef{}
+	if err := d.list(path, map[string]string{
+		parentField + "_id": fmt.Sprint(parent.ID),
+		"name":              name,
+	}, &ifaces); err != nil {
+		return 0, err
+	}
+	if len(ifaces) > 0 {
+		return ifaces[0].ID, nil
+	}
+
+	created := &netboxRef{}
+	if _, err := d.do(&netboxRequest{
+		method: "POST",
+		path:   path,
+		body: map[string]interface{}{
+			parentField: parent.ID,
+			"name":      name,
+			"type":      "virtual",
+		},
+	}, created); err != nil {
+		return 0, err
+	}
+	d.logger.Printf("Interface %s created on %s", name, parent.Name)
+	return created.ID, nil
+}
+
+// deleteInterface remove the interface with id from the parent
+func (d *NetboxDriver) deleteInterface(id int64) error {
+	_, path, _ := d.assignment.paths()
+	_, err := d.do(&netboxRequest{
+		method:     "DELETE",
+		path:       path + "{id}/",
+		pathParams: map[string]string{"id": fmt.Sprint(id)},
+	}, nil)
+	if err == nil {
+		d.logger.Printf("Interface %d deleted", id)
+	}
+	return err
+}
+
+// assignFields return the fields of address assigning it to the interface
+// with id, or unassigning it if id is 0. Netbox 2.9+ uses a generic relation
+// instead of the interface field.
+func (d *NetboxDriver) assignFields(id int64) (map[string]interface{}, error) {
+	version, err := d.getVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var ref interface{}
+	if id != 0 {
+		ref = id
+	}
+	if !version.atLeast(2, 9) {
+		return map[string]interface{}{"interface": ref}, nil
+	}
+
+	var objectType interface{}
+	if id != 0 {
+		objectType = "virtualization.vminterface"
+		if d.assignment.Device != "" {
+			objectType = "dcim.interface"
+		}
+	}
+	return map[string]interface{}{
+		"assigned_object_type": objectType,
+		"assigned_object_id":   ref,
+	}, nil
+}
+
+// assignedInterface return the id of interface the address is assigned to
+func (addr *netboxAddress) assignedInterface() int64 {
+	if addr.AssignedObjectID != nil {
+		return *addr.AssignedObjectID
+	}
+	if addr.Interface != nil {
+		return addr.Interface.ID
+	}
+	return 0
+}
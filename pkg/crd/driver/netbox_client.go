@@ -0,0 +1,178 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	runtimeclient "github.com/go-openapi/runtime/client"
+	"github.com/go-openapi/strfmt"
+	"github.com/netbox-community/go-netbox/netbox/client"
+)
+
+// NetboxKeyRef refer to a key of Secret or ConfigMap in the namespace of pool
+type NetboxKeyRef struct {
+	// Kind is "Secret" or "ConfigMap", default to "Secret"
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// KeyRefGetter read the data a NetboxKeyRef refers to
+type KeyRefGetter func(ref *NetboxKeyRef) ([]byte, error)
+
+// ResolveRefs load the CA and client certificate refered by config with get.
+// It need to be called before NewNetboxDriver if any ref is set.
+func (config *NetboxDriverConfig) ResolveRefs(get KeyRefGetter) (err error) {
+	for _, item := range []struct {
+		ref  *NetboxKeyRef
+		data *[]byte
+	}{
+		{config.CARef, &config.caData},
+		{config.ClientCertRef, &config.certData},
+		{config.ClientKeyRef, &config.keyData},
+	} {
+		if item.ref == nil {
+			continue
+		}
+		if *item.data, err = get(item.ref); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// tlsConfig build the tls config from config, or nil if default is fine
+func (config *NetboxDriverConfig) tlsConfig() (*tls.Config, error) {
+	if config.CARef != nil && config.caData == nil ||
+		config.ClientCertRef != nil && config.certData == nil ||
+		config.ClientKeyRef != nil && config.keyData == nil {
+		return nil, fmt.Errorf("tls refs of netbox config not resolved")
+	}
+	if config.caData == nil && config.certData == nil && !config.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.caData != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(config.caData) {
+			return nil, fmt.Errorf("no certificate found in ca of netbox config")
+		}
+	}
+	if config.certData != nil || config.keyData != nil {
+		cert, err := tls.X509KeyPair(config.certData, config.keyData)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// clientIdleTimeout is how long a cached netbox client is kept unused
+const clientIdleTimeout = 10 * time.Minute
+
+// cachedClient is a go-netbox client with the last time it was used
+type cachedClient struct {
+	client   *client.NetBox
+	lastUsed time.Time
+}
+
+var (
+	netboxClientsLock sync.Mutex
+	netboxClients     = map[string]*cachedClient{}
+)
+
+// clientKey return the key of the client built from config, which is the host
+// and a hash of the other options the client depends on
+func (config *NetboxDriverConfig) clientKey() (string, error) {
+	data, err := json.Marshal(struct {
+		Scheme, APIKey, Proxy     string
+		InsecureSkipVerify, Debug bool
+		RateLimit                 float64
+		RateBurst                 int
+		MaxRetries                *int
+		CAData, CertData, KeyData []byte
+	}{
+		config.Scheme, config.APIKey, config.Proxy,
+		config.InsecureSkipVerify, config.Debug,
+		config.RateLimit,
+		config.RateBurst,
+		config.MaxRetries,
+		config.caData, config.certData, config.keyData,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return config.Host + "/" + hex.EncodeToString(sum[:]), nil
+}
+
+// getNetboxClient return the cached client of config, built on first use.
+// The clients unused for clientIdleTimeout are dropped.
+func getNetboxClient(config *NetboxDriverConfig) (*client.NetBox, error) {
+	key, err := config.clientKey()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	netboxClientsLock.Lock()
+	defer netboxClientsLock.Unlock()
+	for k, cached := range netboxClients {
+		if now.Sub(cached.lastUsed) > clientIdleTimeout {
+			delete(netboxClients, k)
+		}
+	}
+	cached, ok := netboxClients[key]
+	if !ok {
+		c, err := newNetboxClient(config)
+		if err != nil {
+			return nil, err
+		}
+		cached = &cachedClient{client: c}
+		netboxClients[key] = cached
+	}
+	cached.lastUsed = now
+	return cached.client, nil
+}
+
+// newNetboxClient build the go-netbox client with the scheme, tls and proxy
+// options of config
+func newNetboxClient(config *NetboxDriverConfig) (*client.NetBox, error) {
+	scheme := config.Scheme
+	if scheme == "" {
+		scheme = "http"
+	} else if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("unknown scheme %s", scheme)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	if config.Proxy != "" {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	t := runtimeclient.New(config.Host, client.DefaultBasePath, []string{scheme})
+	t.Transport = newGuardedTransport(transport, scheme+"://"+config.Host, config)
+	t.DefaultAuthentication = runtimeclient.APIKeyAuth(
+		"Authorization", "header", "Token "+config.APIKey)
+	return client.New(t, strfmt.Default), nil
+}
@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeNetbox serve the netbox api to the driver in tests. Prefixes and
+// addresses are given as raw json objects, and the writes of driver are
+// recorded.
+type fakeNetbox struct {
+	*httptest.Server
+	t *testing.T
+
+	// version is the API-Version header, default to 2.8. status is the
+	// netbox-version reported by /api/status/, which answers 404 if empty.
+	version string
+	status  string
+
+	// prefixes is the prefix object of each cidr, addresses the json array
+	// of ip address objects listed under each parent prefix
+	prefixes  map[string]string
+	addresses map[string]string
+
+	// handle, if set, serve a request before the fake does, and return
+	// false to let the fake go on with it
+	handle func(w http.ResponseWriter, r *http.Request) bool
+
+	// patched is the bodies of PATCH requests by path, deleted is the paths
+	// of DELETE requests
+	patched map[string][]map[string]interface{}
+	deleted []string
+}
+
+// newFakeNetbox start a fake netbox, to be closed by the caller
+func newFakeNetbox(t *testing.T) *fakeNetbox {
+	f := &fakeNetbox{
+		t:         t,
+		version:   "2.8",
+		prefixes:  map[string]string{},
+		addresses: map[string]string{},
+		patched:   map[string][]map[string]interface{}{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// host return the host of fake for NetboxDriverConfig.Host
+func (f *fakeNetbox) host() string {
+	return strings.TrimPrefix(f.URL, "http://")
+}
+
+// lastPatch return the body of the last PATCH request to path, or nil
+func (f *fakeNetbox) lastPatch(path string) map[string]interface{} {
+	patches := f.patched[path]
+	if len(patches) == 0 {
+		return nil
+	}
+	return patches[len(patches)-1]
+}
+
+func (f *fakeNetbox) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("API-Version", f.version)
+	w.Header().Set("Content-Type", "application/json")
+	if f.handle != nil && f.handle(w, r) {
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/status/":
+		if f.status == "" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"detail": "Not found."}`))
+			return
+		}
+		fmt.Fprintf(w, `{"netbox-version": %q}`, f.status)
+	case r.URL.Path == "/api/extras/tags/" && r.Method == "GET":
+		// every tag exists already
+		f.writeList(w, `[{"id": 1}]`)
+	case r.URL.Path == "/api/ipam/prefixes/" && r.Method == "GET":
+		results := "[]"
+		if prefix, ok := f.prefixes[r.URL.Query().Get("prefix")]; ok {
+			results = "[" + prefix + "]"
+		}
+		f.writeList(w, results)
+	case r.URL.Path == "/api/ipam/ip-addresses/" && r.Method == "GET":
+		results, ok := f.addresses[r.URL.Query().Get("parent")]
+		if !ok {
+			results = "[]"
+		}
+		f.writeList(w, results)
+	case r.Method == "PATCH":
+		fields := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&fields)
+		f.patched[r.URL.Path] = append(f.patched[r.URL.Path], fields)
+		w.Write([]byte(`{"id": 1}`))
+	case r.Method == "DELETE":
+		f.deleted = append(f.deleted, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// writeList write results, a json array, as a page of netbox list
+func (f *fakeNetbox) writeList(w http.ResponseWriter, results string) {
+	items := []json.RawMessage{}
+	if err := json.Unmarshal([]byte(results), &items); err != nil {
+		f.t.Errorf("invalid fake results %s: %v", results, err)
+	}
+	fmt.Fprintf(w, `{"count": %d, "next": null, "results": %s}`, len(items), results)
+}
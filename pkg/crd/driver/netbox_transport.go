@@ -0,0 +1,241 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrDriverUnreachable is wrapped by the errors which mean the external ipam
+// service cannot be reached, rather than it refused the request
+var ErrDriverUnreachable = errors.New("driver backend unreachable")
+
+const (
+	defaultRateLimit  = 10
+	defaultRateBurst  = 20
+	defaultMaxRetries = 3
+
+	// retryBaseDelay is doubled on each retry, and jittered by up to itself
+	retryBaseDelay = 200 * time.Millisecond
+
+	// breakerThreshold consecutive failures open the breaker for breakerCooldown
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+
+	// guardIdleTimeout is how long the guard of a host is kept unused. It
+	// outlives the cached clients, see clientIdleTimeout.
+	guardIdleTimeout = 3 * clientIdleTimeout
+)
+
+// hostGuard rate limits and circuit breaks the calls to one host. It is shared
+// by every driver talking to the same host.
+type hostGuard struct {
+	limiter *rate.Limiter
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+	lastUsed  time.Time
+}
+
+var (
+	hostGuardsLock sync.Mutex
+	hostGuards     = map[string]*hostGuard{}
+)
+
+// getHostGuard return the guard of host, created with limit and burst on
+// first use. The latest limit given wins, the burst is kept as created. The
+// guards unused for guardIdleTimeout are dropped.
+func getHostGuard(host string, limit rate.Limit, burst int) *hostGuard {
+	now := time.Now()
+	hostGuardsLock.Lock()
+	defer hostGuardsLock.Unlock()
+	for h, guard := range hostGuards {
+		if guard.idleSince(now) > guardIdleTimeout {
+			delete(hostGuards, h)
+		}
+	}
+	guard, ok := hostGuards[host]
+	if !ok {
+		guard = &hostGuard{limiter: rate.NewLimiter(limit, burst)}
+		hostGuards[host] = guard
+	} else if guard.limiter.Limit() != limit {
+		guard.limiter.SetLimit(limit)
+	}
+	guard.touch(now)
+	return guard
+}
+
+// touch record that the guard is used at now
+func (g *hostGuard) touch(now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.lastUsed = now
+}
+
+// idleSince return how long the guard is unused at now
+func (g *hostGuard) idleSince(now time.Time) time.Duration {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return now.Sub(g.lastUsed)
+}
+
+// allow report whether a call may go through the breaker. After the cooldown
+// only one probing call is let through until it succeeds or fails.
+func (g *hostGuard) allow(now time.Time) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.lastUsed = now
+	if g.failures < breakerThreshold {
+		return true
+	}
+	if now.Before(g.openUntil) || g.probing {
+		return false
+	}
+	g.probing = true
+	return true
+}
+
+// record the outcome of a call
+func (g *hostGuard) record(ok bool, now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.probing = false
+	if ok {
+		g.failures = 0
+		return
+	}
+	g.failures++
+	if g.failures >= breakerThreshold {
+		g.openUntil = now.Add(breakerCooldown)
+	}
+}
+
+// guardedTransport retry the idempotent requests failing with connection
+// errors, 429 or 5xx with jittered backoff, and pass every request through
+// the rate limit and circuit breaker of its host. A 5xx left after the
+// retries is returned as ErrDriverUnreachable.
+type guardedTransport struct {
+	next       http.RoundTripper
+	guard      *hostGuard
+	maxRetries int
+}
+
+// isIdempotent report whether req can be sent again safely. PATCH is, as the
+// driver always patches fields to their final values.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// notProcessed report whether the outcome of a call means the request never
+// reached netbox, or was refused before it did anything, so that even a POST
+// can be sent again
+func notProcessed(res *http.Response, err error) bool {
+	if err != nil {
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	return res.StatusCode == http.StatusTooManyRequests
+}
+
+// canRetry report whether req can be sent again after the outcome of a call
+func canRetry(req *http.Request, res *http.Response, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	return isIdempotent(req) || notProcessed(res, err)
+}
+
+// shouldRetry report whether the outcome of a call is worth a retry
+func shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+// isFailure report whether the outcome of a call counts against the breaker.
+// A 429 does not, the host is up and only asks to slow down.
+func isFailure(res *http.Response, err error) bool {
+	return err != nil || res.StatusCode >= 500
+}
+
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	return delay + time.Duration(rand.Int63n(int64(delay)))
+}
+
+// RoundTrip impl http.RoundTripper
+func (t *guardedTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	for attempt := 0; ; attempt++ {
+		if !t.guard.allow(time.Now()) {
+			return nil, fmt.Errorf("%w: circuit breaker of %s is open",
+				ErrDriverUnreachable, req.URL.Host)
+		}
+		if err = t.guard.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		if attempt > 0 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		res, err = t.next.RoundTrip(req)
+		t.guard.record(!isFailure(res, err), time.Now())
+
+		if !shouldRetry(res, err) || !canRetry(req, res, err) || attempt >= t.maxRetries {
+			break
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrDriverUnreachable, err)
+	} else if res.StatusCode >= 500 {
+		res.Body.Close()
+		err = fmt.Errorf("%w: %s %s answered %s",
+			ErrDriverUnreachable, req.Method, req.URL.Path, res.Status)
+		res = nil
+	}
+	return
+}
+
+// newGuardedTransport wrap next with the guard of host configured by config
+func newGuardedTransport(next http.RoundTripper, host string, config *NetboxDriverConfig) *guardedTransport {
+	limit, burst := rate.Limit(defaultRateLimit), defaultRateBurst
+	if config.RateLimit > 0 {
+		limit = rate.Limit(config.RateLimit)
+	}
+	if config.RateBurst > 0 {
+		burst = config.RateBurst
+	}
+	maxRetries := defaultMaxRetries
+	if config.MaxRetries != nil {
+		maxRetries = *config.MaxRetries
+	}
+	return &guardedTransport{
+		next:       next,
+		guard:      getHostGuard(host, limit, burst),
+		maxRetries: maxRetries,
+	}
+}
+
+var _ http.RoundTripper = &guardedTransport{}
@@ -0,0 +1,146 @@
+package driver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuardedTransportRetry(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	maxRetries := 3
+	transport := newGuardedTransport(http.DefaultTransport, server.URL,
+		&NetboxDriverConfig{MaxRetries: &maxRetries})
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("GET not retried: status %d after %d calls", res.StatusCode, calls)
+	}
+
+	calls = 0
+	req, _ = http.NewRequest("PATCH", server.URL, strings.NewReader(`{"status": "active"}`))
+	if res, err = transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("PATCH not retried: status %d after %d calls", res.StatusCode, calls)
+	}
+
+	// the 503 may have created something already, the 5xx is left to caller
+	calls = 0
+	req, _ = http.NewRequest("POST", server.URL, nil)
+	if _, err = transport.RoundTrip(req); !errors.Is(err, ErrDriverUnreachable) || calls != 1 {
+		t.Errorf("POST should not be retried on 5xx: %v after %d calls", err, calls)
+	}
+}
+
+func TestGuardedTransportRetryPost(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	maxRetries := 3
+	transport := newGuardedTransport(http.DefaultTransport, server.URL+"/post",
+		&NetboxDriverConfig{MaxRetries: &maxRetries})
+
+	// a 429 refused the request, so it is sent again
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader(`{}`))
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("POST not retried on 429: status %d after %d calls", res.StatusCode, calls)
+	}
+	if transport.guard.failures != 0 {
+		t.Errorf("429 should not count against the breaker, got %d failures", transport.guard.failures)
+	}
+}
+
+func TestGuardedTransportPersistent5xx(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	maxRetries := 1
+	transport := newGuardedTransport(http.DefaultTransport, server.URL+"/5xx",
+		&NetboxDriverConfig{MaxRetries: &maxRetries})
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, ErrDriverUnreachable) || calls != 2 {
+		t.Errorf("expect unreachable after %d calls, got %v after %d", 2, err, calls)
+	}
+}
+
+func TestHostGuardEviction(t *testing.T) {
+	idle := getHostGuard("http://idle.example.com", defaultRateLimit, defaultRateBurst)
+	idle.touch(time.Now().Add(-guardIdleTimeout - time.Second))
+	getHostGuard("http://busy.example.com", defaultRateLimit, defaultRateBurst)
+
+	hostGuardsLock.Lock()
+	_, kept := hostGuards["http://idle.example.com"]
+	hostGuardsLock.Unlock()
+	if kept {
+		t.Errorf("expect the idle guard dropped")
+	}
+}
+
+func TestHostGuardBreaker(t *testing.T) {
+	guard := &hostGuard{}
+	now := time.Now()
+	for idx := 0; idx < breakerThreshold; idx++ {
+		if !guard.allow(now) {
+			t.Fatalf("breaker opened after %d failures", idx)
+		}
+		guard.record(false, now)
+	}
+	if guard.allow(now) {
+		t.Errorf("breaker not opened after %d failures", breakerThreshold)
+	}
+
+	later := now.Add(breakerCooldown)
+	if !guard.allow(later) {
+		t.Errorf("probe not allowed after cooldown")
+	}
+	if guard.allow(later) {
+		t.Errorf("only one probe should be allowed")
+	}
+	guard.record(true, later)
+	if !guard.allow(later) {
+		t.Errorf("breaker not closed after successful probe")
+	}
+}
+
+func TestGuardedTransportUnreachable(t *testing.T) {
+	maxRetries := 0
+	transport := newGuardedTransport(http.DefaultTransport, "http://127.0.0.1:1",
+		&NetboxDriverConfig{MaxRetries: &maxRetries})
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:1", nil)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, ErrDriverUnreachable) {
+		t.Errorf("connection error should be unreachable: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package driver
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// NetboxWebhookSignatureHeader is the header netbox put the HMAC-SHA512 of
+// webhook body in, when a secret is configured on the webhook
+const NetboxWebhookSignatureHeader = "X-Hook-Signature"
+
+// netboxWebhook is the body of a netbox webhook
+type netboxWebhook struct {
+	Event string         `json:"event"`
+	Model string         `json:"model"`
+	Data  *netboxAddress `json:"data"`
+}
+
+// VerifyNetboxSignature check signature, the hex HMAC-SHA512 netbox sent in
+// NetboxWebhookSignatureHeader, against body and secret. Nothing is verified
+// with an empty secret.
+func VerifyNetboxSignature(body []byte, signature, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// ParseNetboxWebhook return the pools the ip address of a netbox webhook
+// body belongs to, found by the pool tags and the pool custom field. Events
+// of other models give no pools.
+func ParseNetboxWebhook(body []byte) (pools []string, err error) {
+	hook := &netboxWebhook{}
+	if err = json.Unmarshal(body, hook); err != nil {
+		return
+	}
+	if hook.Model != "ipaddress" || hook.Data == nil {
+		return
+	}
+
+	for _, tag := range hook.Data.Tags {
+		if strings.HasPrefix(tag, netboxPoolTagPrefix) {
+			pools = append(pools, strings.TrimPrefix(tag, netboxPoolTagPrefix))
+		}
+	}
+	if pool, ok := hook.Data.CustomFields[netboxFieldPool].(string); ok && pool != "" {
+		pools = append(pools, pool)
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyNetboxSignature(t *testing.T) {
+	body := []byte(`{"event": "updated"}`)
+	mac := hmac.New(sha512.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if !VerifyNetboxSignature(body, signature, "secret") {
+		t.Errorf("valid signature rejected")
+	}
+	if VerifyNetboxSignature(body, signature, "other") {
+		t.Errorf("signature of other secret accepted")
+	}
+	if VerifyNetboxSignature([]byte(`{}`), signature, "secret") {
+		t.Errorf("signature of other body accepted")
+	}
+	if VerifyNetboxSignature(body, "not hex", "secret") {
+		t.Errorf("malformed signature accepted")
+	}
+
+	mac = hmac.New(sha512.New, []byte{})
+	mac.Write(body)
+	if VerifyNetboxSignature(body, hex.EncodeToString(mac.Sum(nil)), "") {
+		t.Errorf("signature of empty secret accepted")
+	}
+}
+
+func TestParseNetboxWebhook(t *testing.T) {
+	for _, c := range []struct {
+		body  string
+		pools []string
+	}{
+		{`{"event": "created", "model": "ipaddress", "data": {"id": 1,
+		  "tags": [{"slug": "k8s-automated"}, {"slug": "k8s-pool-a"}]}}`,
+			[]string{"a"}},
+		{`{"event": "deleted", "model": "ipaddress", "data": {"id": 1,
+		  "tags": ["k8s-automated"], "custom_fields": {"k8s_pool": "b"}}}`,
+			[]string{"b"}},
+		{`{"event": "updated", "model": "prefix", "data": {"id": 1,
+		  "tags": ["k8s-pool-a"]}}`,
+			nil},
+	} {
+		pools, err := ParseNetboxWebhook([]byte(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pools, c.pools) {
+			t.Errorf("expect pools %v of %s, got %v", c.pools, c.body, pools)
+		}
+	}
+
+	if _, err := ParseNetboxWebhook([]byte(`not json`)); err == nil {
+		t.Errorf("malformed body should fail")
+	}
+}
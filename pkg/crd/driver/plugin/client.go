@@ -0,0 +1,212 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+	"github.com/jbliao/kubeipam/pkg/crd/driver"
+)
+
+// callTimeout bounds every call made to a plugin
+const callTimeout = 30 * time.Second
+
+// PluginAddress impl driver.IpamAddress with the marks reported by plugin
+type PluginAddress struct {
+	net.IP
+	marks  map[string]struct{}
+	holder string
+}
+
+// MarkedWith ...
+func (pa *PluginAddress) MarkedWith(mark string) bool {
+	_, ok := pa.marks[mark]
+	return ok
+}
+
+// ForeignHolder impl driver.ForeignHolder with the holder reported by plugin
+func (pa *PluginAddress) ForeignHolder() string {
+	return pa.holder
+}
+
+var _ driver.IpamAddress = &PluginAddress{}
+var _ driver.ForeignHolder = &PluginAddress{}
+
+// Client impl the driver.Driver interface by calling a plugin over gRPC. The
+// optional driver interfaces are implemented as well, returning
+// driver.ErrUnsupported if the driver of plugin lacks them.
+type Client struct {
+	conn      *grpc.ClientConn
+	logger    *log.Logger
+	namespace string
+	poolID    string
+	rawConfig string
+
+	// usage is what the plugin reported with the last GetAddresses
+	usage []v1alpha1.PrefixUsage
+}
+
+// Dial connect to the plugin at endpoint. endpoint is either a path of unix
+// socket (optionally prefixed with "unix://") or a "host:port" tcp address.
+func Dial(endpoint string) (*grpc.ClientConn, error) {
+	network, address := "tcp", endpoint
+	if strings.HasPrefix(endpoint, "unix://") {
+		network, address = "unix", strings.TrimPrefix(endpoint, "unix://")
+	} else if strings.HasPrefix(endpoint, "/") {
+		network = "unix"
+	}
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	return grpc.Dial(endpoint,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(dialer),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(CodecName)),
+	)
+}
+
+// NewClient construct a Client which pass rawConfig to plugin on conn, for
+// the pool in namespace
+func NewClient(conn *grpc.ClientConn, namespace, rawConfig string) (*Client, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("nil conn in NewClient")
+	}
+	return &Client{
+		conn:      conn,
+		namespace: namespace,
+		rawConfig: rawConfig,
+		logger:    log.New(log.Writer(), "Plugin", log.Flags()),
+	}, nil
+}
+
+func (c *Client) pool() Pool {
+	return Pool{Namespace: c.namespace, ID: c.poolID, RawConfig: c.rawConfig}
+}
+
+func (c *Client) invoke(method string, req, res interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	err := c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, res)
+	if err != nil {
+		c.logger.Printf("Plugin call %s failed: %v", method, err)
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			err = fmt.Errorf("%w: %v", driver.ErrDriverUnreachable, err)
+		case codes.Unimplemented:
+			err = fmt.Errorf("%w: %v", driver.ErrUnsupported, err)
+		}
+	}
+	return err
+}
+
+// GetAddresses ...
+func (c *Client) GetAddresses() (ret []driver.IpamAddress, err error) {
+	res := &GetAddressesResponse{}
+	if err = c.invoke("GetAddresses", &GetAddressesRequest{Pool: c.pool()}, res); err != nil {
+		return
+	}
+	for _, msg := range res.Addresses {
+		ip := net.ParseIP(msg.Address)
+		if ip == nil {
+			err = fmt.Errorf("plugin returned invalid address %s", msg.Address)
+			c.logger.Println(err)
+			return nil, err
+		}
+		addr := &PluginAddress{IP: ip, marks: map[string]struct{}{}, holder: msg.Holder}
+		for _, mark := range msg.Marks {
+			addr.marks[mark] = struct{}{}
+		}
+		ret = append(ret, addr)
+	}
+	c.usage = nil
+	for _, usage := range res.Usage {
+		c.usage = append(c.usage, v1alpha1.PrefixUsage(usage))
+	}
+	return
+}
+
+// Usage impl driver.UsageReporter, nil if the driver of plugin does not
+// report it
+func (c *Client) Usage() []v1alpha1.PrefixUsage {
+	return c.usage
+}
+
+// MarkAddressAllocated ...
+func (c *Client) MarkAddressAllocated(addr driver.IpamAddress, alct *v1alpha1.IPAllocation) error {
+	return c.invoke("MarkAddressAllocated", &MarkAddressAllocatedRequest{
+		Pool:       c.pool(),
+		Address:    addr.String(),
+		Allocation: *alct,
+	}, &Empty{})
+}
+
+// MarkAddressReleased ...
+func (c *Client) MarkAddressReleased(addr driver.IpamAddress) error {
+	return c.invoke("MarkAddressReleased", &MarkAddressReleasedRequest{
+		Pool:    c.pool(),
+		Address: addr.String(),
+	}, &Empty{})
+}
+
+// CreateAddress ...
+func (c *Client) CreateAddress(count int) error {
+	return c.invoke("CreateAddress", &CreateAddressRequest{
+		Pool:  c.pool(),
+		Count: count,
+	}, &Empty{})
+}
+
+// DeleteAddress ...
+func (c *Client) DeleteAddress(addr driver.IpamAddress) error {
+	return c.invoke("DeleteAddress", &DeleteAddressRequest{
+		Pool:    c.pool(),
+		Address: addr.String(),
+	}, &Empty{})
+}
+
+// CreateAddressAt impl driver.SpecificAddressCreator
+func (c *Client) CreateAddressAt(ip net.IP) error {
+	return c.invoke("CreateAddressAt", &CreateAddressAtRequest{
+		Pool:    c.pool(),
+		Address: ip.String(),
+	}, &Empty{})
+}
+
+// Reclaim impl driver.Reclaimer
+func (c *Client) Reclaim(addr driver.IpamAddress) error {
+	return c.invoke("Reclaim", &ReclaimRequest{
+		Pool:    c.pool(),
+		Address: addr.String(),
+	}, &Empty{})
+}
+
+// Forget tell the plugin to drop the driver of pool, once it is deleted
+func (c *Client) Forget() error {
+	return c.invoke("Forget", &ForgetRequest{Pool: c.pool()}, &Empty{})
+}
+
+// SetPoolID ...
+func (c *Client) SetPoolID(poolID string) {
+	c.poolID = poolID
+}
+
+// SetLogger ...
+func (c *Client) SetLogger(lgr *log.Logger) {
+	if lgr != nil {
+		c.logger = lgr
+	}
+}
+
+var _ driver.Driver = &Client{}
+var _ driver.UsageReporter = &Client{}
+var _ driver.SpecificAddressCreator = &Client{}
+var _ driver.Reclaimer = &Client{}
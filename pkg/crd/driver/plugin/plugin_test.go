@@ -0,0 +1,351 @@
+package plugin
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+	"github.com/jbliao/kubeipam/pkg/crd/driver"
+)
+
+type fakeAddress struct {
+	net.IP
+	marks  map[string]struct{}
+	holder string
+}
+
+func (fa *fakeAddress) MarkedWith(mark string) bool {
+	_, ok := fa.marks[mark]
+	return ok
+}
+
+func (fa *fakeAddress) ForeignHolder() string { return fa.holder }
+
+// fakeDriver keep addresses in memory, shared by every driver the factory build
+type fakeDriver struct {
+	addrs     []*fakeAddress
+	next      net.IP
+	poolID    string
+	rawConfig string
+
+	// builds and lists count the drivers built and the listings made
+	builds int
+	lists  int
+}
+
+func (d *fakeDriver) GetAddresses() (ret []driver.IpamAddress, err error) {
+	d.lists++
+	for _, addr := range d.addrs {
+		ret = append(ret, addr)
+	}
+	return
+}
+
+func (d *fakeDriver) MarkAddressAllocated(addr driver.IpamAddress, alct *v1alpha1.IPAllocation) error {
+	addr.(*fakeAddress).marks[driver.Allocated] = struct{}{}
+	return nil
+}
+
+func (d *fakeDriver) MarkAddressReleased(addr driver.IpamAddress) error {
+	delete(addr.(*fakeAddress).marks, driver.Allocated)
+	return nil
+}
+
+func (d *fakeDriver) CreateAddress(count int) error {
+	for ; count > 0; count-- {
+		d.next[len(d.next)-1]++
+		d.addrs = append(d.addrs, &fakeAddress{
+			IP:    append(net.IP{}, d.next...),
+			marks: map[string]struct{}{driver.Automated: {}},
+		})
+	}
+	return nil
+}
+
+func (d *fakeDriver) DeleteAddress(addr driver.IpamAddress) error {
+	for idx, a := range d.addrs {
+		if a == addr {
+			d.addrs = append(d.addrs[:idx], d.addrs[idx+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (d *fakeDriver) SetPoolID(poolID string) { d.poolID = poolID }
+func (d *fakeDriver) SetLogger(*log.Logger)   {}
+
+// reclaimingDriver is a fakeDriver with the optional driver interfaces
+type reclaimingDriver struct {
+	*fakeDriver
+}
+
+func (d *reclaimingDriver) CreateAddressAt(ip net.IP) error {
+	d.addrs = append(d.addrs, &fakeAddress{IP: ip, marks: map[string]struct{}{}})
+	return nil
+}
+
+func (d *reclaimingDriver) Reclaim(addr driver.IpamAddress) error {
+	addr.(*fakeAddress).holder = ""
+	return nil
+}
+
+func (d *reclaimingDriver) Usage() []v1alpha1.PrefixUsage {
+	return []v1alpha1.PrefixUsage{{Prefix: "10.1.1.0/24", Capacity: 254, Used: int64(len(d.addrs))}}
+}
+
+// startPlugin run a plugin serving fake on a unix socket in a temp dir
+func startPlugin(t *testing.T, fake *fakeDriver) (endpoint string, stop func()) {
+	return startPluginWith(t, fake, fake)
+}
+
+// startPluginWith run a plugin serving d, which keeps its state in fake
+func startPluginWith(t *testing.T, fake *fakeDriver, d driver.Driver) (endpoint string, stop func()) {
+	dir, err := ioutil.TempDir("", "kubeipam-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint = filepath.Join(dir, "fake.sock")
+	lis, err := net.Listen("unix", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(func(rawConfig string) (driver.Driver, error) {
+		fake.rawConfig = rawConfig
+		fake.builds++
+		return d, nil
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(lis)
+	return endpoint, func() {
+		lis.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPluginRoundTrip(t *testing.T) {
+	fake := &fakeDriver{next: net.ParseIP("10.1.1.0").To4()}
+	endpoint, stop := startPlugin(t, fake)
+	defer stop()
+
+	conn, err := Dial(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := NewClient(conn, "default", `{"prefix":"10.1.1.0/24"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetPoolID("pool-a")
+
+	if err := client.CreateAddress(2); err != nil {
+		t.Fatal(err)
+	}
+	if fake.poolID != "pool-a" || fake.rawConfig != `{"prefix":"10.1.1.0/24"}` {
+		t.Errorf("pool not passed to plugin: %q %q", fake.poolID, fake.rawConfig)
+	}
+
+	addrs, err := client.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || !addrs[0].Equal(net.ParseIP("10.1.1.1")) {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+	if !addrs[0].MarkedWith(driver.Automated) || addrs[0].MarkedWith(driver.Allocated) {
+		t.Errorf("unexpected marks on %v", addrs[0])
+	}
+
+	if err := client.MarkAddressAllocated(addrs[0], &v1alpha1.IPAllocation{
+		Address:      "10.1.1.1",
+		PodName:      "pod",
+		PodNamespace: "default",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, err = client.GetAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	if !addrs[0].MarkedWith(driver.Allocated) {
+		t.Errorf("%v not marked allocated", addrs[0])
+	}
+
+	if err := client.DeleteAddress(addrs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.addrs) != 1 {
+		t.Errorf("address not deleted: %v", fake.addrs)
+	}
+
+	if err := client.MarkAddressReleased(&PluginAddress{IP: net.ParseIP("10.9.9.9")}); err == nil {
+		t.Errorf("release of unknown address should fail")
+	}
+}
+
+// dialPlugin connect a client of default/pool-a to the plugin at endpoint
+func dialPlugin(t *testing.T, endpoint string) (*Client, func()) {
+	conn, err := Dial(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(conn, "default", `{"prefix":"10.1.1.0/24"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetPoolID("pool-a")
+	return client, func() { conn.Close() }
+}
+
+func TestPluginCachesDriver(t *testing.T) {
+	fake := &fakeDriver{next: net.ParseIP("10.1.1.0").To4()}
+	endpoint, stop := startPlugin(t, fake)
+	defer stop()
+	client, done := dialPlugin(t, endpoint)
+	defer done()
+
+	if err := client.CreateAddress(3); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := client.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if err := client.MarkAddressAllocated(addr, &v1alpha1.IPAllocation{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.builds != 1 {
+		t.Errorf("expect the driver built once, got %d", fake.builds)
+	}
+	if fake.lists != 1 {
+		t.Errorf("expect addresses found in the listing, got %d listings", fake.lists)
+	}
+
+	// the listing is dropped once the addresses change
+	if err := client.CreateAddress(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.MarkAddressAllocated(&PluginAddress{IP: net.ParseIP("10.1.1.4")},
+		&v1alpha1.IPAllocation{}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.lists != 2 {
+		t.Errorf("expect the pool listed again, got %d listings", fake.lists)
+	}
+
+	// a new config gets a new driver
+	client.rawConfig = `{"prefix":"10.1.2.0/24"}`
+	if _, err := client.GetAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.builds != 2 {
+		t.Errorf("expect a driver built for the new config, got %d", fake.builds)
+	}
+}
+
+func TestPluginEvictsDriver(t *testing.T) {
+	fake := &fakeDriver{next: net.ParseIP("10.1.1.0").To4()}
+	endpoint, stop := startPlugin(t, fake)
+	defer stop()
+	client, done := dialPlugin(t, endpoint)
+	defer done()
+
+	if _, err := client.GetAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	// a pool of the same name in another namespace is another pool
+	other, otherDone := dialPlugin(t, endpoint)
+	defer otherDone()
+	other.namespace = "other"
+	if _, err := other.GetAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.builds != 2 {
+		t.Errorf("expect a driver built for each namespace, got %d", fake.builds)
+	}
+
+	// a deleted pool is built again if it comes back
+	if err := client.Forget(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.builds != 3 {
+		t.Errorf("expect the driver built again after forget, got %d", fake.builds)
+	}
+}
+
+func TestUsageWireFormat(t *testing.T) {
+	// int64 is a string in the proto3 json mapping
+	res := &GetAddressesResponse{}
+	data := `{"addresses": [], "usage": [{"prefix": "10.1.1.0/24", "capacity": "254", "used": "3"}]}`
+	if err := (jsonCodec{}).Unmarshal([]byte(data), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Usage) != 1 || res.Usage[0].Capacity != 254 || res.Usage[0].Used != 3 {
+		t.Errorf("unexpected usage %v", res.Usage)
+	}
+}
+
+func TestPluginOptionalInterfaces(t *testing.T) {
+	fake := &fakeDriver{next: net.ParseIP("10.1.1.0").To4()}
+	endpoint, stop := startPluginWith(t, fake, &reclaimingDriver{fake})
+	defer stop()
+	client, done := dialPlugin(t, endpoint)
+	defer done()
+
+	if err := client.CreateAddressAt(net.ParseIP("10.1.1.9")); err != nil {
+		t.Fatal(err)
+	}
+	fake.addrs[0].holder = "dhcp"
+	addrs, err := client.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.1.1.9")) {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+	if holder := addrs[0].(driver.ForeignHolder).ForeignHolder(); holder != "dhcp" {
+		t.Errorf("expect holder dhcp, got %q", holder)
+	}
+	if usage := client.Usage(); len(usage) != 1 || usage[0].Used != 1 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+	if err := client.Reclaim(addrs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if fake.addrs[0].holder != "" {
+		t.Errorf("address not reclaimed")
+	}
+}
+
+func TestPluginUnsupported(t *testing.T) {
+	fake := &fakeDriver{next: net.ParseIP("10.1.1.0").To4()}
+	endpoint, stop := startPlugin(t, fake)
+	defer stop()
+	client, done := dialPlugin(t, endpoint)
+	defer done()
+
+	if err := client.CreateAddressAt(net.ParseIP("10.1.1.9")); !errors.Is(err, driver.ErrUnsupported) {
+		t.Errorf("expect ErrUnsupported, got %v", err)
+	}
+	if _, err := client.GetAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	if usage := client.Usage(); usage != nil {
+		t.Errorf("expect no usage, got %v", usage)
+	}
+}
@@ -0,0 +1,119 @@
+// Package plugin exposes the driver.Driver interface over gRPC, so that a
+// driver can run out of process (as a sidecar or a standalone binary
+// listening on a unix socket) instead of being compiled into the manager.
+//
+// Messages are plain go structs encoded with the "json" codec registered by
+// this package, so no generated protobuf code is needed on either side. Their
+// schema is published in driver.proto, whose proto3 json mapping is the wire
+// format, for plugins written in other languages. Every request carries the
+// pool it is issued for. The server keeps a driver and its
+// last address listing for each pool and config it has seen, so that a sync
+// does not build a driver and list the pool again on every call.
+//
+// The optional driver interfaces (UsageReporter, SpecificAddressCreator,
+// Reclaimer and ForeignHolder of the addresses) are carried too. A plugin
+// whose driver lacks one answers codes.Unimplemented, which the client turns
+// into driver.ErrUnsupported.
+package plugin
+
+import (
+	"github.com/jbliao/kubeipam/api/v1alpha1"
+)
+
+const (
+	// ServiceName is the full gRPC service name of a driver plugin
+	ServiceName = "kubeipam.driver.v1alpha1.Driver"
+
+	// CodecName is the content-subtype used by client and server
+	CodecName = "json"
+)
+
+// Pool identifies the IPPool a request is made for, by its namespace and
+// name
+type Pool struct {
+	// Namespace is the namespace of the IPPool
+	Namespace string `json:"namespace"`
+
+	// ID is the name of the IPPool, as given to driver.Driver.SetPoolID
+	ID string `json:"id"`
+
+	// RawConfig is IPPoolSpec.RawConfig, passed through as is
+	RawConfig string `json:"rawConfig"`
+}
+
+// Address is the wire form of a driver.IpamAddress
+type Address struct {
+	Address string   `json:"address"`
+	Marks   []string `json:"marks,omitempty"`
+
+	// Holder is who holds the address outside k8s, see driver.ForeignHolder
+	Holder string `json:"holder,omitempty"`
+}
+
+// Empty is used for calls without request or response payload
+type Empty struct{}
+
+// GetAddressesRequest ...
+type GetAddressesRequest struct {
+	Pool Pool `json:"pool"`
+}
+
+// GetAddressesResponse ...
+type GetAddressesResponse struct {
+	Addresses []Address `json:"addresses"`
+
+	// Usage is what driver.UsageReporter reports after the listing, nil if
+	// the driver does not
+	Usage []PrefixUsage `json:"usage,omitempty"`
+}
+
+// PrefixUsage is the wire form of a v1alpha1.PrefixUsage. The counts are
+// strings, as int64 is in the proto3 json mapping.
+type PrefixUsage struct {
+	Prefix   string `json:"prefix"`
+	Capacity int64  `json:"capacity,string"`
+	Used     int64  `json:"used,string"`
+	Pool     int64  `json:"pool,string"`
+}
+
+// MarkAddressAllocatedRequest ...
+type MarkAddressAllocatedRequest struct {
+	Pool       Pool                  `json:"pool"`
+	Address    string                `json:"address"`
+	Allocation v1alpha1.IPAllocation `json:"allocation"`
+}
+
+// MarkAddressReleasedRequest ...
+type MarkAddressReleasedRequest struct {
+	Pool    Pool   `json:"pool"`
+	Address string `json:"address"`
+}
+
+// CreateAddressRequest ...
+type CreateAddressRequest struct {
+	Pool  Pool `json:"pool"`
+	Count int  `json:"count"`
+}
+
+// DeleteAddressRequest ...
+type DeleteAddressRequest struct {
+	Pool    Pool   `json:"pool"`
+	Address string `json:"address"`
+}
+
+// CreateAddressAtRequest ...
+type CreateAddressAtRequest struct {
+	Pool    Pool   `json:"pool"`
+	Address string `json:"address"`
+}
+
+// ReclaimRequest ...
+type ReclaimRequest struct {
+	Pool    Pool   `json:"pool"`
+	Address string `json:"address"`
+}
+
+// ForgetRequest ...
+type ForgetRequest struct {
+	Pool Pool `json:"pool"`
+}
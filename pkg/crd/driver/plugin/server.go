@@ -0,0 +1,366 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jbliao/kubeipam/pkg/crd/driver"
+)
+
+// knownMarks are the marks reported back to the client for each address
+var knownMarks = []string{driver.Automated, driver.Allocated, driver.Adopted}
+
+// Factory construct a driver from the raw config of a pool
+type Factory func(rawConfig string) (driver.Driver, error)
+
+// DriverServer is the server side of the driver plugin service
+type DriverServer interface {
+	GetAddresses(context.Context, *GetAddressesRequest) (*GetAddressesResponse, error)
+	MarkAddressAllocated(context.Context, *MarkAddressAllocatedRequest) (*Empty, error)
+	MarkAddressReleased(context.Context, *MarkAddressReleasedRequest) (*Empty, error)
+	CreateAddress(context.Context, *CreateAddressRequest) (*Empty, error)
+	DeleteAddress(context.Context, *DeleteAddressRequest) (*Empty, error)
+	CreateAddressAt(context.Context, *CreateAddressAtRequest) (*Empty, error)
+	Reclaim(context.Context, *ReclaimRequest) (*Empty, error)
+	Forget(context.Context, *ForgetRequest) (*Empty, error)
+}
+
+// poolDriver is the driver of a pool with its last address listing. Calls on
+// it are serialized, as drivers keep state between them.
+type poolDriver struct {
+	sync.Mutex
+	driver.Driver
+
+	// rawConfig is the config the driver is built from
+	rawConfig string
+
+	// listing is the last addresses of GetAddresses by their string form,
+	// nil once the addresses of pool changed
+	listing map[string]driver.IpamAddress
+}
+
+// list get the addresses of pool and keep them as the listing
+func (pd *poolDriver) list() ([]driver.IpamAddress, error) {
+	pd.listing = nil
+	addrs, err := pd.GetAddresses()
+	if err != nil {
+		return nil, err
+	}
+	pd.listing = map[string]driver.IpamAddress{}
+	for _, addr := range addrs {
+		pd.listing[addr.String()] = addr
+	}
+	return addrs, nil
+}
+
+// find get the address of pool which equal to raw from the listing, listing
+// the pool again if it is not there
+func (pd *poolDriver) find(raw string) (driver.IpamAddress, error) {
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return nil, fmt.Errorf("cannot parse address %s", raw)
+	}
+	if addr, ok := pd.listing[ip.String()]; ok {
+		return addr, nil
+	}
+	if _, err := pd.list(); err != nil {
+		return nil, err
+	}
+	if addr, ok := pd.listing[ip.String()]; ok {
+		return addr, nil
+	}
+	return nil, fmt.Errorf("address %s not found in pool", raw)
+}
+
+// Server serve a driver.Driver implementation over gRPC
+type Server struct {
+	factory Factory
+	logger  *log.Logger
+
+	mu      sync.Mutex
+	drivers map[poolKey]*poolDriver
+}
+
+// poolKey is the namespace and name of a pool, which key its driver
+type poolKey struct {
+	namespace, id string
+}
+
+// NewServer construct a Server which use factory to build the driver of
+// each pool
+func NewServer(factory Factory, logger *log.Logger) (*Server, error) {
+	if factory == nil {
+		return nil, fmt.Errorf("nil factory in NewServer")
+	}
+	if logger == nil {
+		return nil, fmt.Errorf("nil logger in NewServer")
+	}
+	return &Server{factory: factory, logger: logger, drivers: map[poolKey]*poolDriver{}}, nil
+}
+
+// Register register the driver service on s
+func (s *Server) Register(gs *grpc.Server) {
+	gs.RegisterService(&serviceDesc, s)
+}
+
+// Serve accept connections on lis and serve the driver service on them
+func (s *Server) Serve(lis net.Listener) error {
+	gs := grpc.NewServer()
+	s.Register(gs)
+	s.logger.Printf("Serving driver plugin on %s", lis.Addr())
+	return gs.Serve(lis)
+}
+
+var _ DriverServer = &Server{}
+
+// driverFor return the driver of pool, built on its first call, locked for
+// the caller to unlock. The driver of a former config of pool is dropped.
+func (s *Server) driverFor(pool Pool) (*poolDriver, error) {
+	key := poolKey{namespace: pool.Namespace, id: pool.ID}
+	s.mu.Lock()
+	pd, ok := s.drivers[key]
+	if !ok || pd.rawConfig != pool.RawConfig {
+		d, err := s.factory(pool.RawConfig)
+		if err != nil {
+			s.mu.Unlock()
+			s.logger.Println(err)
+			return nil, err
+		}
+		d.SetPoolID(pool.ID)
+		d.SetLogger(s.logger)
+		pd = &poolDriver{Driver: d, rawConfig: pool.RawConfig}
+		s.drivers[key] = pd
+	}
+	s.mu.Unlock()
+	pd.Lock()
+	return pd, nil
+}
+
+// unsupported tell the client the driver lacks the optional interface of
+// method
+func unsupported(method string) error {
+	return status.Errorf(codes.Unimplemented, "driver does not support %s", method)
+}
+
+// GetAddresses ...
+func (s *Server) GetAddresses(ctx context.Context, req *GetAddressesRequest) (*GetAddressesResponse, error) {
+	pd, err := s.driverFor(req.Pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Unlock()
+	addrs, err := pd.list()
+	if err != nil {
+		return nil, err
+	}
+	res := &GetAddressesResponse{Addresses: []Address{}}
+	for _, addr := range addrs {
+		msg := Address{Address: addr.String()}
+		for _, mark := range knownMarks {
+			if addr.MarkedWith(mark) {
+				msg.Marks = append(msg.Marks, mark)
+			}
+		}
+		if holder, ok := addr.(driver.ForeignHolder); ok {
+			msg.Holder = holder.ForeignHolder()
+		}
+		res.Addresses = append(res.Addresses, msg)
+	}
+	if reporter, ok := pd.Driver.(driver.UsageReporter); ok {
+		for _, usage := range reporter.Usage() {
+			res.Usage = append(res.Usage, PrefixUsage(usage))
+		}
+	}
+	return res, nil
+}
+
+// MarkAddressAllocated ...
+func (s *Server) MarkAddressAllocated(ctx context.Context, req *MarkAddressAllocatedRequest) (*Empty, error) {
+	pd, err := s.driverFor(req.Pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Unlock()
+	addr, err := pd.find(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, pd.MarkAddressAllocated(addr, &req.Allocation)
+}
+
+// MarkAddressReleased ...
+func (s *Server) MarkAddressReleased(ctx context.Context, req *MarkAddressReleasedRequest) (*Empty, error) {
+	pd, err := s.driverFor(req.Pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Unlock()
+	addr, err := pd.find(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, pd.MarkAddressReleased(addr)
+}
+
+// CreateAddress ...
+func (s *Server) CreateAddress(ctx context.Context, req *CreateAddressRequest) (*Empty, error) {
+	pd, err := s.driverFor(req.Pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Unlock()
+	pd.listing = nil
+	return &Empty{}, pd.CreateAddress(req.Count)
+}
+
+// DeleteAddress ...
+func (s *Server) DeleteAddress(ctx context.Context, req *DeleteAddressRequest) (*Empty, error) {
+	pd, err := s.driverFor(req.Pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Unlock()
+	addr, err := pd.find(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	pd.listing = nil
+	return &Empty{}, pd.DeleteAddress(addr)
+}
+
+// CreateAddressAt ...
+func (s *Server) CreateAddressAt(ctx context.Context, req *CreateAddressAtRequest) (*Empty, error) {
+	pd, err := s.driverFor(req.Pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Unlock()
+	creator, ok := pd.Driver.(driver.SpecificAddressCreator)
+	if !ok {
+		return nil, unsupported("CreateAddressAt")
+	}
+	ip := net.ParseIP(req.Address)
+	if ip == nil {
+		return nil, fmt.Errorf("cannot parse address %s", req.Address)
+	}
+	pd.listing = nil
+	return &Empty{}, creator.CreateAddressAt(ip)
+}
+
+// Reclaim ...
+func (s *Server) Reclaim(ctx context.Context, req *ReclaimRequest) (*Empty, error) {
+	pd, err := s.driverFor(req.Pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Unlock()
+	reclaimer, ok := pd.Driver.(driver.Reclaimer)
+	if !ok {
+		return nil, unsupported("Reclaim")
+	}
+	addr, err := pd.find(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	pd.listing = nil
+	return &Empty{}, reclaimer.Reclaim(addr)
+}
+
+// Forget drop the driver of pool, e.g. once the pool is deleted
+func (s *Server) Forget(ctx context.Context, req *ForgetRequest) (*Empty, error) {
+	s.mu.Lock()
+	delete(s.drivers, poolKey{namespace: req.Pool.Namespace, id: req.Pool.ID})
+	s.mu.Unlock()
+	return &Empty{}, nil
+}
+
+// toStatus let the client know the backend of driver is unreachable
+func toStatus(err error) error {
+	if errors.Is(err, driver.ErrDriverUnreachable) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
+
+// unaryHandler adapt a typed method of DriverServer to grpc.methodHandler
+func unaryHandler(method string, newReq func() interface{},
+	call func(DriverServer, context.Context, interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newReq()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				res, err := call(srv.(DriverServer), ctx, req)
+				return res, toStatus(err)
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + ServiceName + "/" + method,
+			}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*DriverServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("GetAddresses",
+			func() interface{} { return &GetAddressesRequest{} },
+			func(s DriverServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.GetAddresses(ctx, req.(*GetAddressesRequest))
+			}),
+		unaryHandler("MarkAddressAllocated",
+			func() interface{} { return &MarkAddressAllocatedRequest{} },
+			func(s DriverServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.MarkAddressAllocated(ctx, req.(*MarkAddressAllocatedRequest))
+			}),
+		unaryHandler("MarkAddressReleased",
+			func() interface{} { return &MarkAddressReleasedRequest{} },
+			func(s DriverServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.MarkAddressReleased(ctx, req.(*MarkAddressReleasedRequest))
+			}),
+		unaryHandler("CreateAddress",
+			func() interface{} { return &CreateAddressRequest{} },
+			func(s DriverServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.CreateAddress(ctx, req.(*CreateAddressRequest))
+			}),
+		unaryHandler("DeleteAddress",
+			func() interface{} { return &DeleteAddressRequest{} },
+			func(s DriverServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.DeleteAddress(ctx, req.(*DeleteAddressRequest))
+			}),
+		unaryHandler("CreateAddressAt",
+			func() interface{} { return &CreateAddressAtRequest{} },
+			func(s DriverServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.CreateAddressAt(ctx, req.(*CreateAddressAtRequest))
+			}),
+		unaryHandler("Reclaim",
+			func() interface{} { return &ReclaimRequest{} },
+			func(s DriverServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.Reclaim(ctx, req.(*ReclaimRequest))
+			}),
+		unaryHandler("Forget",
+			func() interface{} { return &ForgetRequest{} },
+			func(s DriverServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.Forget(ctx, req.(*ForgetRequest))
+			}),
+	},
+	Streams: []grpc.StreamDesc{},
+}